@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/got-reload/got-reload/pkg/reloader"
+)
+
+var BuildUsage string = `%[1]s [flags] [<package>]
+
+Filter the watched packages and build a reload-enabled executable of the given
+main package, plus a metadata file next to it (the executable's name with %[2]q
+appended) that tells the reloader which packages to watch and where their
+source is. Start the executable however you like, with its own arguments; set
+any of the GOT_RELOAD_* environment variables to override the metadata file.
+Unlike "run", nothing rebuilds and restarts the program for changes that cannot
+be hot-reloaded.
+
+Flags:
+
+`
+
+func build(selfName string, args []string) {
+	var flags sessionFlags
+	var output string
+
+	set := flag.NewFlagSet(selfName, flag.ExitOnError)
+	flags.register(set)
+	set.StringVar(&output, "o", "", "The executable to write (default: the main package's base name, in the current directory)")
+	set.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), BuildUsage, selfName, reloader.MetadataSuffix)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		set.Usage()
+		os.Exit(1)
+	}
+	if set.NArg() > 1 {
+		set.Usage()
+		exitf(FailedUsage, "Too many arguments")
+	}
+	cfg, moduleRoot := flags.config(set, set.Arg(0), true)
+
+	s := newSession(cfg, moduleRoot, false)
+	if output == "" {
+		output = filepath.Base(s.mainPath)
+	}
+	binPath, err := filepath.Abs(output)
+	if err != nil {
+		s.exitf(Failed, "Unable to resolve %s: %v", output, err)
+	}
+
+	if err := s.build(binPath); err != nil {
+		s.exitf(FailedBuild, "Failed building %s: %v", s.mainPath, err)
+	}
+
+	env, err := s.reloaderEnv()
+	if err != nil {
+		s.exitf(Failed, "%v", err)
+	}
+	// The executable isn't run with s.goEnv, so its reloader reads
+	// s.vendorEnv from here.
+	for key, val := range s.vendorEnv {
+		env[key] = val
+	}
+	if s.work.Temp && !cfg.Keep {
+		// It's removed below.
+		delete(env, reloader.WorkDirEnv)
+	}
+	byts, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		s.exitf(Failed, "Error encoding metadata: %v", err)
+	}
+	metadataPath := reloader.MetadataPath(binPath)
+	if err := os.WriteFile(metadataPath, append(byts, '\n'), 0644); err != nil {
+		s.exitf(Failed, "Error writing %s: %v", metadataPath, err)
+	}
+
+	// The executable doesn't need the filtered code at run time.
+	s.close()
+	log.Printf("Wrote %s and %s", binPath, metadataPath)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/tabwriter"
+
+	"github.com/got-reload/got-reload/pkg/gotreload"
+)
+
+var CheckUsage string = `%[1]s [flags] package [package ...]
+
+Report, for each function and method in the given packages, whether got-reload
+can hot-reload it, and if not, why not. That includes the ones that the
+exclusion rules in the config file, or given as flags, leave as they are. The
+packages are loaded with the config file's build flags.
+
+Flags:
+
+`
+
+func check(selfName string, args []string) {
+	var asJSON bool
+	var configPath string
+	var excludeFiles, excludeFuncs stringList
+	set := flag.NewFlagSet(selfName, flag.ExitOnError)
+	set.BoolVar(&asJSON, "json", false, "Print the report as JSON")
+	set.StringVar(&configPath, "config", "", "The config file to use instead of "+ConfigFileName+" at the module root")
+	registerExcludes(set, &excludeFiles, &excludeFuncs)
+	set.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), CheckUsage, selfName)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		set.Usage()
+		os.Exit(1)
+	}
+	if set.NArg() < 1 {
+		set.Usage()
+		log.Fatal("No packages specified")
+	}
+
+	// The config file is optional, and so is being in a module.
+	cfg := &Config{}
+	if moduleRoot, err := mainModuleRoot(); err == nil || configPath != "" {
+		if cfg, err = loadConfig(configPath, moduleRoot); err != nil {
+			exitf(FailedUsage, "%v", err)
+		}
+	}
+	set.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "exclude-file":
+			cfg.ExcludeFiles = excludeFiles
+		case "exclude-func":
+			cfg.ExcludeFuncs = excludeFuncs
+		}
+	})
+	if err := cfg.validate(); err != nil {
+		exitf(FailedUsage, "%v", err)
+	}
+
+	r := gotreload.NewRewriter()
+	r.Config.BuildFlags = cfg.BuildFlags
+	r.ExcludeFiles = cfg.ExcludeFiles
+	for _, expr := range cfg.ExcludeFuncs {
+		r.ExcludeFuncs = append(r.ExcludeFuncs, regexp.MustCompile(expr))
+	}
+	if err := r.Load(set.Args()...); err != nil {
+		log.Fatalf("%v", err)
+	}
+	reports := r.Check()
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatalf("Error writing report: %v", err)
+		}
+		return
+	}
+
+	pwd, _ := os.Getwd()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	pkg := ""
+	reloadable := 0
+	summarize := func() {
+		if pkg != "" {
+			fmt.Fprintf(w, "\t%d of %d reloadable\n\n", reloadable, countPkg(reports, pkg))
+		}
+	}
+	for _, report := range reports {
+		if report.Package != pkg {
+			summarize()
+			pkg = report.Package
+			reloadable = 0
+			fmt.Fprintf(w, "%s\n", pkg)
+		}
+		position := report.Position
+		if rel, err := filepath.Rel(pwd, position); err == nil && pwd != "" {
+			position = rel
+		}
+		status := "no"
+		if report.Reloadable {
+			status = "ok"
+			reloadable++
+		}
+		fmt.Fprintf(w, "\t%s\t%s\t%s", status, report.Name, position)
+		for i, reason := range report.Reasons {
+			sep := "; "
+			if i == 0 {
+				sep = "\t"
+			}
+			fmt.Fprintf(w, "%s%s", sep, reason)
+		}
+		fmt.Fprintln(w)
+	}
+	summarize()
+	w.Flush()
+}
+
+func countPkg(reports []gotreload.FuncReport, pkg string) int {
+	n := 0
+	for _, report := range reports {
+		if report.Package == pkg {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigFileName is the name of the project config file that "run" reads
+// from the root of the main module, unless told otherwise with -config.
+const ConfigFileName = ".got-reload.json"
+
+// Config is a project's checked-in got-reload setup. Every field is
+// optional, and the corresponding "run" flag, when given, overrides it.
+type Config struct {
+	// The packages to watch for changes: import paths or patterns, as for
+	// "go list". Relative patterns are relative to the module root. If
+	// there are none, got-reload watches the main module's packages that
+	// the main package imports. (-p)
+	Packages []string `json:"packages"`
+	// The main package to run: an import path, or a directory relative to
+	// the module root. (The first argument to "run".)
+	Main string `json:"main"`
+	// Glob patterns, matched against the base names of files, and regular
+	// expressions, matched against function names as printed by "check"
+	// ("F", "T.M" or "(*T).M"). Matching functions are left compiled as-is,
+	// and not reloaded, as are those in generated files and those with a
+	// //got-reload:skip directive. (-exclude-file, -exclude-func)
+	ExcludeFiles []string `json:"excludeFiles"`
+	ExcludeFuncs []string `json:"excludeFuncs"`
+	// Flags for loading, filtering and building the program, as for "go
+	// build", e.g. ["-tags=dev", "-race"]. (-build-flags)
+	BuildFlags []string `json:"buildFlags"`
+	// Arguments for the program. (The arguments after the main package.)
+	Args []string `json:"args"`
+	// Extra environment variables for the program.
+	Env map[string]string `json:"env"`
+	// How long to wait after a change for more changes before reloading, as
+	// parsed by time.ParseDuration. (-debounce)
+	Debounce string `json:"debounce"`
+	// The work directory to filter into, relative to the module root. It
+	// must be outside the module, and any other local modules it copies. If
+	// it's empty, each run uses a new temporary directory, removed when the
+	// run ends. (-dir)
+	Dir string `json:"dir"`
+	// Whether to rebuild and restart the program when a change can't be
+	// hot-reloaded. (-restart, default true)
+	Restart *bool `json:"restart"`
+	// TCP addresses to keep listening on across restarts. (-listen)
+	Listen []string `json:"listen"`
+	// Pass -v to "go build". (-v)
+	Verbose bool `json:"verbose"`
+	// Update the work directory's go.mod with "go get", which may download
+	// and upgrade modules, instead of working out the changes offline from
+	// go.mod, go.sum and the module cache. (-go-get)
+	GoGet bool `json:"goGet"`
+	// Keep the temporary work directory when the run ends. (-keep)
+	Keep bool `json:"keep"`
+}
+
+// loadConfig reads the config file at path. If path is empty, it reads
+// ConfigFileName from moduleRoot, if there is one. Relative paths in Main,
+// Packages and Dir are resolved against moduleRoot.
+func loadConfig(path, moduleRoot string) (*Config, error) {
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(moduleRoot, ConfigFileName)
+	}
+	cfg := &Config{}
+	byts, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("Error reading config file: %w", err)
+	}
+	if err := json.Unmarshal(byts, cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %w", path, err)
+	}
+
+	if strings.HasPrefix(cfg.Main, ".") {
+		cfg.Main = filepath.Join(moduleRoot, cfg.Main)
+	}
+	for i, pattern := range cfg.Packages {
+		if strings.HasPrefix(pattern, ".") {
+			cfg.Packages[i] = filepath.Join(moduleRoot, pattern)
+		}
+	}
+	if cfg.Dir != "" && !filepath.IsAbs(cfg.Dir) {
+		cfg.Dir = filepath.Join(moduleRoot, cfg.Dir)
+	}
+	if cfg.Dir != "" {
+		if err := checkWorkDir(cfg.Dir, []string{moduleRoot}); err != nil {
+			return nil, fmt.Errorf("Error in config file %s: dir: %w", path, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("Error in config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	for _, pattern := range cfg.ExcludeFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("excludeFiles: %q: %w", pattern, err)
+		}
+	}
+	for _, expr := range cfg.ExcludeFuncs {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("excludeFuncs: %w", err)
+		}
+	}
+	if cfg.Debounce != "" {
+		if _, err := time.ParseDuration(cfg.Debounce); err != nil {
+			return fmt.Errorf("debounce: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkWorkDir returns an error if dir, a work dir, is in one of modules,
+// the local modules it's to hold copies of, or holds one of them, since
+// they'd be copied into themselves.
+func checkWorkDir(dir string, modules []string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for _, module := range modules {
+		if within(dir, module) || within(module, dir) {
+			return fmt.Errorf("The work dir %s overlaps %s, which it copies; it must be outside it", dir, module)
+		}
+	}
+	return nil
+}
+
+// within reports whether path is dir or is in it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// environ returns the program's environment: env, plus cfg.Env.
+func (cfg *Config) environ(env []string) []string {
+	var keys []string
+	for key := range cfg.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+cfg.Env[key])
+	}
+	return env
+}
+
+// stringList is a flag.Value that collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // No config file if empty.
+		// The expected config, given the module root.
+		want    func(root string) *Config
+		wantErr bool
+	}{
+		{
+			name: "no config file",
+			want: func(string) *Config { return &Config{} },
+		},
+		{
+			name:    "empty",
+			content: "{}",
+			want:    func(string) *Config { return &Config{} },
+		},
+		{
+			name:    "relative paths",
+			content: `{"main": "./cmd/app", "packages": ["./internal/...", "example.com/m/a"], "dir": "../work"}`,
+			want: func(root string) *Config {
+				return &Config{
+					Main:     filepath.Join(root, "cmd", "app"),
+					Packages: []string{filepath.Join(root, "internal", "..."), "example.com/m/a"},
+					Dir:      filepath.Join(filepath.Dir(root), "work"),
+				}
+			},
+		},
+		{
+			name:    "import path and absolute dir",
+			content: `{"main": "example.com/m/cmd/app", "dir": "/tmp/work"}`,
+			want: func(string) *Config {
+				return &Config{Main: "example.com/m/cmd/app", Dir: "/tmp/work"}
+			},
+		},
+		{name: "bad JSON", content: `{"packages": "a"}`, wantErr: true},
+		{name: "bad exclude-file pattern", content: `{"excludeFiles": ["["]}`, wantErr: true},
+		{name: "bad exclude-func expression", content: `{"excludeFuncs": ["("]}`, wantErr: true},
+		{name: "bad debounce", content: `{"debounce": "soon"}`, wantErr: true},
+		{name: "dir in the module", content: `{"dir": "tmp/work"}`, wantErr: true},
+		{name: "dir is the module", content: `{"dir": "."}`, wantErr: true},
+		{name: "dir holds the module", content: `{"dir": ".."}`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			if test.content != "" {
+				writeFile(t, filepath.Join(root, ConfigFileName), test.content)
+			}
+			cfg, err := loadConfig("", root)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want(root), cfg)
+		})
+	}
+
+	t.Run("missing explicit config file", func(t *testing.T) {
+		root := t.TempDir()
+		_, err := loadConfig(filepath.Join(root, "other.json"), root)
+		assert.Error(t, err)
+	})
+}
+
+func TestSessionFlagsConfig(t *testing.T) {
+	root := writeModule(t, map[string]string{
+		ConfigFileName: `{
+	"main": "./app",
+	"packages": ["example.com/m/a"],
+	"buildFlags": ["-tags=dev"],
+	"debounce": "1s",
+	"excludeFiles": ["*_gen.go"],
+	"excludeFuncs": ["^init"],
+	"verbose": true
+}`,
+		"other.json": `{"packages": ["example.com/m/other"]}`,
+	})
+	fromFile := Config{
+		Main:         filepath.Join(root, "app"),
+		Packages:     []string{"example.com/m/a"},
+		BuildFlags:   []string{"-tags=dev"},
+		Debounce:     "1s",
+		ExcludeFiles: []string{"*_gen.go"},
+		ExcludeFuncs: []string{"^init"},
+		Verbose:      true,
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		mainPkg string
+		want    func(cfg *Config)
+	}{
+		{
+			name: "config file only",
+			want: func(*Config) {},
+		},
+		{
+			name: "flags override",
+			args: []string{"-p", "example.com/m/b,example.com/m/c", "-build-flags", "-race -tags=x", "-debounce", "5ms", "-v=false", "-keep"},
+			want: func(cfg *Config) {
+				cfg.Packages = []string{"example.com/m/b", "example.com/m/c"}
+				cfg.BuildFlags = []string{"-race", "-tags=x"}
+				cfg.Debounce = "5ms"
+				cfg.Verbose = false
+				cfg.Keep = true
+			},
+		},
+		{
+			name: "long and short forms",
+			args: []string{"-pkgs", "example.com/m/b", "-d", "/tmp/work"},
+			want: func(cfg *Config) {
+				cfg.Packages = []string{"example.com/m/b"}
+				cfg.Dir = "/tmp/work"
+			},
+		},
+		{
+			name: "repeated flags replace lists",
+			args: []string{"-exclude-file", "a.go", "-exclude-file", "b.go"},
+			want: func(cfg *Config) {
+				cfg.ExcludeFiles = []string{"a.go", "b.go"}
+			},
+		},
+		{
+			name:    "main package argument",
+			mainPkg: "example.com/m/cmd/other",
+			want: func(cfg *Config) {
+				cfg.Main = "example.com/m/cmd/other"
+			},
+		},
+		{
+			name: "other config file",
+			args: []string{"-config", "other.json", "-go-get"},
+			want: func(cfg *Config) {
+				*cfg = Config{Packages: []string{"example.com/m/other"}, GoGet: true}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var flags sessionFlags
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.register(set)
+			require.NoError(t, set.Parse(test.args))
+
+			cfg, moduleRoot := flags.config(set, test.mainPkg, false)
+			assert.Equal(t, root, moduleRoot)
+			want := fromFile
+			test.want(&want)
+			assert.Equal(t, &want, cfg)
+		})
+	}
+}
+
+func TestCheckWorkDir(t *testing.T) {
+	modules := []string{"/src/m", "/src/lib"}
+	tests := []struct {
+		dir     string
+		wantErr bool
+	}{
+		{"/tmp/work", false},
+		{"/src/work", false},
+		{"/src/m2", false},
+		{"/src/m", true},
+		{"/src/lib/work", true},
+		{"/src", true},
+		{"/src/m/../work", false},
+	}
+	for _, test := range tests {
+		t.Run(test.dir, func(t *testing.T) {
+			err := checkWorkDir(filepath.FromSlash(test.dir), modules)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
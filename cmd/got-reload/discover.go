@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Directives that override package discovery. Put one on a line of its own
+// before the package clause of any of a package's files.
+const (
+	// Watch the package even though it looks generated.
+	watchDirective = "//got-reload:watch"
+	// Never watch the package.
+	noWatchDirective = "//got-reload:nowatch"
+)
+
+// listedPackage is the part of "go list -json" output that discovery and
+// the filter cache use.
+type listedPackage struct {
+	ImportPath   string
+	Name         string
+	Dir          string
+	ForTest      string
+	GoFiles      []string
+	CgoFiles     []string
+	EmbedFiles   []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+	Deps         []string
+	Standard     bool
+	DepOnly      bool
+	Module       *listedModule
+}
+
+type listedModule struct {
+	Path    string
+	Version string
+	Main    bool
+	Replace *listedModule
+}
+
+// resolvePackages replaces cfg.Packages, which are package patterns as for
+// "go list" (e.g. "./internal/ui/..."), with the import paths of the packages
+// they match. If there are no patterns, it uses every package in a local
+// module (see localModule) that roots (or, with tests set, their tests)
+// import, directly or not. Either way, it leaves out packages that aren't in
+// a local module, packages with cgo files, and packages marked with
+// noWatchDirective. When discovering packages, it also leaves out main
+// packages, and packages whose files are all generated, unless they're marked
+// with watchDirective.
+func (cfg *Config) resolvePackages(roots []string, tests bool) error {
+	explicit := len(cfg.Packages) > 0
+	args := []string{"list", "-json=ImportPath,Name,Dir,ForTest,GoFiles,CgoFiles,Standard,Module"}
+	args = append(args, cfg.BuildFlags...)
+	if explicit {
+		args = append(args, cfg.Packages...)
+	} else {
+		if len(roots) == 0 {
+			return fmt.Errorf("No got-reload packages specified; use -p or %s", ConfigFileName)
+		}
+		args = append(args, "-deps")
+		if tests {
+			args = append(args, "-test")
+		}
+		args = append(args, roots...)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("Failed listing packages: %w\n%s", err, stderr.String())
+	}
+
+	var pkgs []string
+	seen := map[string]bool{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg listedPackage
+		if err := dec.Decode(&pkg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed parsing go list output: %w", err)
+		}
+		// Test variants and test mains show up with "-test"; the packages
+		// they're variants of show up too.
+		if pkg.ForTest != "" || strings.HasSuffix(pkg.ImportPath, ".test") || seen[pkg.ImportPath] {
+			continue
+		}
+		seen[pkg.ImportPath] = true
+		if pkg.Standard || !localModule(pkg.Module) {
+			if explicit {
+				log.Printf("Not watching %s: it's not in a local module", pkg.ImportPath)
+			}
+			continue
+		}
+		if len(pkg.CgoFiles) > 0 {
+			log.Printf("Not watching %s: it uses cgo", pkg.ImportPath)
+			continue
+		}
+		watch, noWatch, generated := packageDirectives(pkg)
+		if noWatch {
+			log.Printf("Not watching %s: it's marked %s", pkg.ImportPath, noWatchDirective)
+			continue
+		}
+		if !explicit && !watch {
+			if pkg.Name == "main" {
+				continue
+			}
+			if generated {
+				log.Printf("Not watching %s: it's generated; mark it %s to watch it anyway", pkg.ImportPath, watchDirective)
+				continue
+			}
+		}
+		pkgs = append(pkgs, pkg.ImportPath)
+	}
+	if len(pkgs) == 0 {
+		return fmt.Errorf("No packages to watch")
+	}
+	if !explicit {
+		log.Printf("Watching %s", strings.Join(pkgs, ", "))
+	}
+	cfg.Packages = pkgs
+	return nil
+}
+
+// localModule reports whether m is a module whose source we can copy and
+// watch: the main module or a workspace module, or a module replaced by a
+// local directory. got-reload itself never counts.
+func localModule(m *listedModule) bool {
+	if m == nil || m.Path == reloaderModule {
+		return false
+	}
+	return m.Main || (m.Replace != nil && m.Replace.Version == "")
+}
+
+// packageDirectives reports whether any of pkg's files are marked with
+// watchDirective or noWatchDirective, and whether all of them are generated.
+func packageDirectives(pkg listedPackage) (watch, noWatch, generated bool) {
+	generated = len(pkg.GoFiles) > 0
+	fset := token.NewFileSet()
+	for _, name := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			generated = false
+			continue
+		}
+		generated = generated && ast.IsGenerated(file)
+		for _, group := range file.Comments {
+			if group.Pos() > file.Package {
+				break
+			}
+			for _, comment := range group.List {
+				switch strings.TrimSpace(comment.Text) {
+				case watchDirective:
+					watch = true
+				case noWatchDirective:
+					noWatch = true
+				}
+			}
+		}
+	}
+	return watch, noWatch, generated
+}
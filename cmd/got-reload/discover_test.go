@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const generatedHeader = "// Code generated by gen. DO NOT EDIT.\n\n"
+
+func TestPackageDirectives(t *testing.T) {
+	tests := []struct {
+		name                      string
+		files                     map[string]string
+		watch, noWatch, generated bool
+	}{
+		{"plain", map[string]string{"a.go": "package p\n"}, false, false, false},
+		{"no files", map[string]string{}, false, false, false},
+		{"generated", map[string]string{"a.go": generatedHeader + "package p\n", "b.go": generatedHeader + "package p\n"}, false, false, true},
+		{"partly generated", map[string]string{"a.go": generatedHeader + "package p\n", "b.go": "package p\n"}, false, false, false},
+		{"watch", map[string]string{"a.go": generatedHeader + watchDirective + "\npackage p\n", "b.go": generatedHeader + "package p\n"}, true, false, true},
+		{"nowatch", map[string]string{"a.go": "package p\n", "b.go": "// Package p.\n" + noWatchDirective + "\npackage p\n"}, false, true, false},
+		{"after the package clause", map[string]string{"a.go": "package p\n\n" + watchDirective + "\n" + noWatchDirective + "\n"}, false, false, false},
+		{"in a doc comment", map[string]string{"a.go": "// See " + watchDirective + ".\npackage p\n"}, false, false, false},
+		{"unparsable", map[string]string{"a.go": generatedHeader + "packag p\n"}, false, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pkg := listedPackage{Dir: dir}
+			for name, content := range test.files {
+				writeFile(t, filepath.Join(dir, name), content)
+				pkg.GoFiles = append(pkg.GoFiles, name)
+			}
+			watch, noWatch, generated := packageDirectives(pkg)
+			assert.Equal(t, test.watch, watch, "watch")
+			assert.Equal(t, test.noWatch, noWatch, "noWatch")
+			assert.Equal(t, test.generated, generated, "generated")
+		})
+	}
+}
+
+func TestResolvePackages(t *testing.T) {
+	writeModule(t, map[string]string{
+		"app/main.go": `package main
+
+import (
+	_ "example.com/m/a"
+	_ "example.com/m/gen"
+	_ "example.com/m/genwatch"
+	_ "example.com/m/skip"
+)
+
+func main() {}
+`,
+		"app/main_test.go": "package main\n\nimport _ \"example.com/m/testonly\"\n",
+		"a/a.go":           "package a\n\nimport _ \"example.com/m/b\"\n",
+		"b/b.go":           "package b\n",
+		"gen/gen.go":       generatedHeader + "package gen\n",
+		"genwatch/gen.go":  generatedHeader + watchDirective + "\npackage genwatch\n",
+		"skip/skip.go":     noWatchDirective + "\npackage skip\n",
+		"testonly/t.go":    "package testonly\n",
+		"unused/unused.go": "package unused\n",
+	})
+
+	tests := []struct {
+		name     string
+		packages []string
+		tests    bool
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "discovered",
+			want: []string{"example.com/m/b", "example.com/m/a", "example.com/m/genwatch"},
+		},
+		{
+			name:  "discovered with tests",
+			tests: true,
+			want:  []string{"example.com/m/b", "example.com/m/a", "example.com/m/genwatch", "example.com/m/testonly"},
+		},
+		{
+			name:     "explicit",
+			packages: []string{"./..."},
+			want: []string{"example.com/m/a", "example.com/m/app", "example.com/m/b", "example.com/m/gen",
+				"example.com/m/genwatch", "example.com/m/testonly", "example.com/m/unused"},
+		},
+		{
+			name:     "explicit, marked nowatch",
+			packages: []string{"./skip"},
+			wantErr:  true,
+		},
+		{
+			name:     "explicit, not local",
+			packages: []string{"fmt"},
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{Packages: test.packages}
+			err := cfg.resolvePackages([]string{"./app"}, test.tests)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.ElementsMatch(t, test.want, cfg.Packages)
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/got-reload/got-reload/pkg/cache"
+	"github.com/got-reload/got-reload/pkg/extract"
+	"github.com/got-reload/got-reload/pkg/gotreload"
+	"github.com/got-reload/got-reload/pkg/util"
+	"golang.org/x/tools/go/packages"
+)
+
+// filterCache computes the cache keys of the filter's output, from "go list"
+// output for the watched packages and everything they depend on.
+type filterCache struct {
+	// nil if the cache is disabled.
+	c *cache.Cache
+	// Hashed into every key.
+	settings []string
+	pwd      string
+	// The import paths of the packages that the patterns given to
+	// newFilterCache match, dependencies first.
+	roots []string
+	// Listed packages by import path, and the test variants of each package
+	// by the import path of the package they're for.
+	pkgs     map[string]*listedPackage
+	variants map[string][]*listedPackage
+	// Memoized ownHash results.
+	hashes map[string]string
+}
+
+// newFilterCache lists pkgs and their dependencies (including their tests'
+// dependencies, with tests set). settings are any filter options that change
+// its output.
+func newFilterCache(pkgs, buildFlags []string, tests bool, pwd string, settings ...string) (*filterCache, error) {
+	env, err := exec.Command("go", "env", "GOVERSION", "GOOS", "GOARCH", "GOFLAGS", "CGO_ENABLED").Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed running go env: %w", err)
+	}
+	fc := &filterCache{
+		settings: append([]string{cache.ToolVersion(), string(env), strings.Join(buildFlags, "\x00"), fmt.Sprint(tests)}, settings...),
+		pwd:      pwd,
+		pkgs:     map[string]*listedPackage{},
+		variants: map[string][]*listedPackage{},
+		hashes:   map[string]string{},
+	}
+
+	args := []string{"list", "-deps", "-json=ImportPath,Name,Dir,ForTest,GoFiles,CgoFiles,EmbedFiles,TestGoFiles,XTestGoFiles,Imports,TestImports,XTestImports,Deps,Standard,DepOnly,Module"}
+	args = append(args, buildFlags...)
+	if tests {
+		args = append(args, "-test")
+	}
+	args = append(args, pkgs...)
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing packages: %w\n%s", err, stderr.String())
+	}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		pkg := &listedPackage{}
+		if err := dec.Decode(pkg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed parsing go list output: %w", err)
+		}
+		if strings.HasSuffix(pkg.ImportPath, ".test") {
+			continue
+		}
+		path := variantPath(pkg.ImportPath)
+		if pkg.ForTest != "" {
+			fc.variants[pkg.ForTest] = append(fc.variants[pkg.ForTest], pkg)
+			// A package that only tests import may only be listed as a
+			// variant.
+			if fc.pkgs[path] != nil {
+				continue
+			}
+		} else if !pkg.DepOnly {
+			fc.roots = append(fc.roots, path)
+		}
+		fc.pkgs[path] = pkg
+	}
+
+	dir, err := cache.Dir()
+	if err != nil {
+		log.Printf("Not caching filtered packages: %v", err)
+		return fc, nil
+	}
+	if dir != "" {
+		if fc.c, err = cache.Open(dir); err != nil {
+			log.Printf("Not caching filtered packages: %v", err)
+		}
+	}
+	return fc, nil
+}
+
+// variantPath returns the import path of the package that id, a package ID
+// as listed by "go list -test" (e.g. "p [p.test]"), is a variant of.
+func variantPath(id string) string {
+	if i := strings.Index(id, " ["); i >= 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// ownHash returns a hash of the package with the given import path by
+// itself: its version if it's in the standard library or an unvendored
+// module dependency, and its files' contents if not. It returns "" if the
+// package wasn't listed, so that its contents are unknown.
+func (fc *filterCache) ownHash(path string) (string, error) {
+	if hash, ok := fc.hashes[path]; ok {
+		return hash, nil
+	}
+	pkg := fc.pkgs[path]
+	var hash string
+	switch {
+	case pkg == nil:
+		return "", nil
+	case pkg.Standard:
+		// The Go version is in fc.settings.
+		hash = "std " + path
+	// Vendored copies can be patched, so they're hashed like local packages.
+	case moduleVersion(pkg.Module) != "" && !strings.Contains(pkg.Dir, string(filepath.Separator)+"vendor"+string(filepath.Separator)):
+		hash = "module " + path + " " + moduleVersion(pkg.Module)
+	default:
+		var names []string
+		for _, files := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.EmbedFiles, pkg.TestGoFiles, pkg.XTestGoFiles} {
+			names = append(names, files...)
+		}
+		files, err := cache.HashFiles(pkg.Dir, names)
+		if err != nil {
+			return "", fmt.Errorf("Error hashing %s: %w", path, err)
+		}
+		// Output paths are relative to fc.pwd, and the //line directives in
+		// filtered files hold absolute paths.
+		rel, err := filepath.Rel(fc.pwd, pkg.Dir)
+		if err != nil {
+			rel = pkg.Dir
+		}
+		hash = cache.Key("files", path, pkg.Name, rel, pkg.Dir, files)
+	}
+	fc.hashes[path] = hash
+	return hash, nil
+}
+
+// moduleVersion returns the version of m, or of its replacement, or "" if it
+// has none, i.e. if its source can change.
+func moduleVersion(m *listedModule) string {
+	if m == nil {
+		return ""
+	}
+	if m.Replace != nil {
+		m = m.Replace
+	}
+	if m.Version == "" {
+		return ""
+	}
+	return m.Path + "@" + m.Version
+}
+
+// key returns the cache key for a kind of output of the package with the
+// given import path, with extra as any further inputs. It covers the package,
+// everything it (or, with tests, its tests) depends on, and fc.settings. It
+// returns "", for output that mustn't be cached, if any of those packages
+// wasn't listed, e.g. because path is a pattern rather than an import path.
+func (fc *filterCache) key(kind, path string, extra ...string) (string, error) {
+	deps := map[string]bool{}
+	if pkg := fc.pkgs[path]; pkg != nil {
+		for _, dep := range pkg.Deps {
+			deps[variantPath(dep)] = true
+		}
+	}
+	for _, variant := range fc.variants[path] {
+		for _, dep := range variant.Deps {
+			deps[variantPath(dep)] = true
+		}
+	}
+	delete(deps, path)
+	depPaths := make([]string, 0, len(deps))
+	for dep := range deps {
+		depPaths = append(depPaths, dep)
+	}
+	sort.Strings(depPaths)
+
+	parts := append(append([]string{}, fc.settings...), kind)
+	for _, p := range append([]string{path}, depPaths...) {
+		hash, err := fc.ownHash(p)
+		if err != nil || hash == "" {
+			return "", err
+		}
+		parts = append(parts, hash)
+	}
+	return cache.Key(append(parts, extra...)...), nil
+}
+
+func (fc *filterCache) get(key string) (*cache.Entry, bool) {
+	if fc.c == nil || key == "" {
+		return nil, false
+	}
+	return fc.c.Get(key)
+}
+
+// put caches e, unless key is "". Failing to is not an error; the next run
+// just does the work again.
+func (fc *filterCache) put(key string, e *cache.Entry) {
+	if fc.c == nil || key == "" {
+		return
+	}
+	if err := fc.c.Put(key, e); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// depRegistration is a file registering the symbols of an unwatched package
+// that watched packages import, so that reloaded code can use them.
+type depRegistration struct {
+	// The import path of the package to register.
+	path string
+	// Where to write the file, in which package, and the end of its name.
+	dir, destPkg, suffix string
+}
+
+func (reg depRegistration) fileName() string {
+	return filepath.Join(reg.dir, "grl_"+strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(reg.path)+reg.suffix)
+}
+
+// depRegistrations returns the registration files to write for the
+// non-standard, non-internal, unwatched packages the watched packages import,
+// directly or not. They go in the first watched package. Packages imported
+// only by _test.go files are registered in a _test.go file in each package
+// whose tests import them, since that's the only place they're sure to be
+// linked in.
+func (fc *filterCache) depRegistrations(r *gotreload.Rewriter, watched []string) []depRegistration {
+	isWatched := map[string]bool{}
+	for _, path := range watched {
+		isWatched[path] = true
+	}
+	var regs []depRegistration
+	add := func(imports map[string]int, dir, destPkg, suffix string) {
+		for path, state := range imports {
+			if state == 2 && !isWatched[path] {
+				regs = append(regs, depRegistration{path: path, dir: dir, destPkg: destPkg, suffix: suffix})
+			}
+		}
+	}
+
+	allImports := map[string]int{}
+	var pkg0 *listedPackage
+	for _, path := range watched {
+		if pkg := fc.pkgs[path]; pkg != nil {
+			if pkg0 == nil {
+				pkg0 = pkg
+			}
+			fc.allImportedPackages(allImports, pkg.Imports)
+		}
+	}
+	if pkg0 == nil {
+		return nil
+	}
+	add(allImports, r.OutputPkgDir(pkg0.Name, pkg0.Dir), relocatedName(pkg0.Name), ".go")
+
+	for _, path := range watched {
+		pkg := fc.pkgs[path]
+		if pkg == nil {
+			continue
+		}
+		for _, test := range []struct {
+			files, imports []string
+			name, suffix   string
+		}{
+			{pkg.TestGoFiles, pkg.TestImports, pkg.Name, "_test.go"},
+			{pkg.XTestGoFiles, pkg.XTestImports, pkg.Name + "_test", "_x_test.go"},
+		} {
+			if len(test.files) == 0 {
+				continue
+			}
+			testImports := map[string]int{}
+			fc.allImportedPackages(testImports, test.imports)
+			for path := range testImports {
+				if allImports[path] > 0 {
+					delete(testImports, path)
+				}
+			}
+			add(testImports, r.OutputPkgDir(test.name, pkg.Dir), relocatedName(test.name), test.suffix)
+		}
+	}
+
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].fileName() < regs[j].fileName()
+	})
+	return regs
+}
+
+// Find all (direct and indirect) packages in imports, and the packages they
+// import
+func (fc *filterCache) allImportedPackages(m map[string]int, imports []string) {
+	for _, path := range imports {
+		if m[path] > 0 {
+			continue
+		}
+		if util.InternalPkg(path) || util.ProbablyStdLib(path) {
+			m[path] = 1
+			continue
+		}
+		m[path] = 2
+		if pkg := fc.pkgs[path]; pkg != nil {
+			fc.allImportedPackages(m, pkg.Imports)
+		}
+	}
+}
+
+// relocatedName is gotreload.RelocatedName for a package name.
+func relocatedName(name string) string {
+	if name == "main" {
+		return gotreload.MainPackageName
+	}
+	return name
+}
+
+// writeDepRegistrations writes regs, restoring them from the cache where it
+// can, and loading the packages to register where it can't. It returns what
+// it wrote.
+func (fc *filterCache) writeDepRegistrations(regs []depRegistration, outputDir string, buildFlags []string) ([]*cache.Entry, error) {
+	var written []*cache.Entry
+	pending := map[string][]depRegistration{}
+	keys := map[depRegistration]string{}
+	for _, reg := range regs {
+		rel, err := filepath.Rel(outputDir, reg.dir)
+		if err != nil {
+			return nil, err
+		}
+		key, err := fc.key("registration", reg.path, rel, reg.destPkg, reg.suffix)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := fc.get(key); ok {
+			if err := e.Restore(outputDir); err != nil {
+				return nil, err
+			}
+			written = append(written, e)
+			continue
+		}
+		keys[reg] = key
+		pending[reg.path] = append(pending[reg.path], reg)
+	}
+	if len(pending) == 0 {
+		return written, nil
+	}
+
+	var paths []string
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	// Registration only needs the packages' types, which come from export
+	// data, so this is much cheaper than loading the watched packages.
+	pkgs, err := packages.Load(&packages.Config{
+		Mode:       packages.NeedName | packages.NeedTypes,
+		BuildFlags: buildFlags,
+	}, paths...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading packages to register: %w", err)
+	}
+	// A package that didn't load is an error, rather than one with nothing
+	// to register, which would be cached as such.
+	for _, pkg := range pkgs {
+		if pkg.Types == nil || len(pkg.Errors) > 0 {
+			return nil, fmt.Errorf("Failed loading %s: %v", pkg.PkgPath, pkg.Errors)
+		}
+		regs := pending[pkg.PkgPath]
+		delete(pending, pkg.PkgPath)
+		for _, reg := range regs {
+			fname := reg.fileName()
+			registrationSource, err := extract.GenContent(fname,
+				reg.destPkg, pkg.PkgPath, pkg.Types,
+				nil, nil, extract.NewImportTracker("", ""))
+			if err != nil {
+				return nil, fmt.Errorf("Failed generating symbol registration for %q: %w", pkg.PkgPath, err)
+			}
+			e := &cache.Entry{Files: map[string][]byte{}}
+			if registrationSource == nil {
+				// It has nothing to register.
+				log.Printf("SKIPPING Registrations for %s / %s -> %s", pkg.Name, pkg.PkgPath, fname)
+			} else {
+				rel, err := filepath.Rel(outputDir, fname)
+				if err != nil {
+					return nil, err
+				}
+				e.Files[rel] = registrationSource
+			}
+			if err := e.Restore(outputDir); err != nil {
+				return nil, err
+			}
+			fc.put(keys[reg], e)
+			written = append(written, e)
+		}
+	}
+	for _, path := range paths {
+		if _, ok := pending[path]; ok {
+			return nil, fmt.Errorf("Failed loading %s", path)
+		}
+	}
+	return written, nil
+}
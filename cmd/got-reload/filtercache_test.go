@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/got-reload/got-reload/pkg/cache"
+	"github.com/got-reload/got-reload/pkg/gotreload"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeModule writes files, by slash-separated path, into a new module
+// example.com/m, and makes it the current directory for the rest of the test.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/m\n\ngo 1.22\n"
+	for name, content := range files {
+		writeFile(t, filepath.Join(dir, filepath.FromSlash(name)), content)
+	}
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	require.NoError(t, os.WriteFile(name, []byte(content), 0644))
+}
+
+func TestFilterPatternAfterEdit(t *testing.T) {
+	t.Setenv(cache.DirEnv, t.TempDir())
+	dir := writeModule(t, map[string]string{
+		"a/a.go": "package a\n\nfunc F() string { return \"v1\" }\n",
+	})
+	out := t.TempDir()
+	filtered := filepath.Join(out, "a", "a.go")
+
+	filter("filter", []string{"-dir", out, "-go-mod=false", "./..."})
+	byts, err := os.ReadFile(filtered)
+	require.NoError(t, err)
+	assert.Contains(t, string(byts), `"v1"`)
+
+	writeFile(t, filepath.Join(dir, "a", "a.go"), "package a\n\nfunc F() string { return \"v2\" }\n")
+	filter("filter", []string{"-dir", out, "-go-mod=false", "./..."})
+	byts, err = os.ReadFile(filtered)
+	require.NoError(t, err)
+	assert.Contains(t, string(byts), `"v2"`, "filtering again after an edit")
+}
+
+func TestFilterCacheKey(t *testing.T) {
+	t.Setenv(cache.DirEnv, "")
+	dir := writeModule(t, map[string]string{
+		"a/a.go": "package a\n\nimport \"example.com/m/c\"\n\nvar X = c.Y\n",
+		"c/c.go": "package c\n\nvar Y = 1\n",
+	})
+	fc, err := newFilterCache([]string{"./..."}, nil, false, dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com/m/c", "example.com/m/a"}, fc.roots)
+
+	tests := []struct {
+		name, path string
+		cached     bool
+	}{
+		{"import path", "example.com/m/a", true},
+		{"pattern", "./...", false},
+		{"directory", "./a", false},
+		{"unlisted package", "example.com/m/b", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := fc.key("package", test.path)
+			require.NoError(t, err)
+			assert.Equal(t, test.cached, key != "")
+		})
+	}
+
+	key, err := fc.key("package", "example.com/m/a")
+	require.NoError(t, err)
+	writeFile(t, filepath.Join(dir, "c", "c.go"), "package c\n\nvar Y = 2\n")
+	fc, err = newFilterCache([]string{"./..."}, nil, false, dir)
+	require.NoError(t, err)
+	edited, err := fc.key("package", "example.com/m/a")
+	require.NoError(t, err)
+	assert.NotEqual(t, key, edited, "key after editing a dependency")
+}
+
+func TestDepRegistrations(t *testing.T) {
+	t.Setenv(cache.DirEnv, t.TempDir())
+	dir := writeModule(t, map[string]string{
+		"a/a.go":      "package a\n\nimport \"example.com/m/c\"\n\nvar X = c.Y\n",
+		"a/a_test.go": "package a\n\nimport \"example.com/m/d\"\n\nvar Z = d.W\n",
+		"c/c.go":      "package c\n\nvar Y = 1\n",
+		"d/d.go":      "package d\n\nvar W = 1\n",
+	})
+	out := t.TempDir()
+	fc, err := newFilterCache([]string{"./a"}, nil, true, dir)
+	require.NoError(t, err)
+	r := gotreload.NewRewriter()
+	r.OutputDir = out
+	r.Pwd = dir
+
+	regs := fc.depRegistrations(r, fc.roots)
+	want := []depRegistration{
+		{path: "example.com/m/c", dir: filepath.Join(out, "a"), destPkg: "a", suffix: ".go"},
+		{path: "example.com/m/d", dir: filepath.Join(out, "a"), destPkg: "a", suffix: "_test.go"},
+	}
+	assert.Equal(t, want, regs)
+
+	for _, restored := range []bool{false, true} {
+		written, err := fc.writeDepRegistrations(regs, out, nil)
+		require.NoError(t, err)
+		assert.Len(t, written, len(regs), "restored: %v", restored)
+		for _, reg := range regs {
+			byts, err := os.ReadFile(reg.fileName())
+			require.NoError(t, err, "restored: %v", restored)
+			assert.Contains(t, string(byts), reg.path)
+		}
+		if !restored {
+			for _, reg := range regs {
+				require.NoError(t, os.Remove(reg.fileName()))
+			}
+		}
+	}
+}
+
+func TestWriteDepRegistrationsLoadError(t *testing.T) {
+	t.Setenv(cache.DirEnv, t.TempDir())
+	dir := writeModule(t, map[string]string{
+		"a/a.go": "package a\n\nimport \"example.com/m/c\"\n\nvar X = c.Y\n",
+		"c/c.go": "package c\n\nvar Y int = \"one\"\n",
+	})
+	out := t.TempDir()
+	fc, err := newFilterCache([]string{"./a"}, nil, false, dir)
+	require.NoError(t, err)
+	r := gotreload.NewRewriter()
+	r.OutputDir = out
+	r.Pwd = dir
+	regs := fc.depRegistrations(r, fc.roots)
+	require.Len(t, regs, 1)
+
+	// Nothing is cached for a package that doesn't load, so it fails again.
+	for i := 0; i < 2; i++ {
+		_, err = fc.writeDepRegistrations(regs, out, nil)
+		assert.ErrorContains(t, err, "example.com/m/c")
+		assert.NoFileExists(t, regs[0].fileName())
+	}
+}
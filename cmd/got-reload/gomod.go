@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/got-reload/got-reload/pkg/cache"
+	"github.com/got-reload/got-reload/pkg/util"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// goModUpdate computes the changes to the copy of the main module's go.mod
+// and go.sum that the filtered code needs, without running the go command,
+// and so without touching the network.
+type goModUpdate struct {
+	// The copy of the main module, and of the go.work file in use, if any.
+	workModule, workGoWork string
+	fc                     *filterCache
+	gomod                  *modfile.File
+	// Module path => replacement, from go.mod and go.work.
+	replaces map[string]module.Version
+	// Known go.sum lines, and the ones the copy's go.sum will have.
+	knownSums, sums map[string]bool
+	modCache        string
+}
+
+// updateGoMod adds requirements on the modules that provide the packages
+// that the generated files in entries import, with their go.sum lines, to
+// the go.mod and go.sum in workModule. Importing got-reload's reloader also
+// means requiring the modules it needs. Versions come from go.mod, from "go
+// list" (via fc), and from got-reload's own go.mod; checksums from go.sum
+// files and the module cache. Existing requirements are never downgraded.
+func updateGoMod(workModule, workGoWork string, fc *filterCache, entries []*cache.Entry) error {
+	u := &goModUpdate{
+		workModule: workModule,
+		workGoWork: workGoWork,
+		fc:         fc,
+		replaces:   map[string]module.Version{},
+		knownSums:  map[string]bool{},
+		sums:       map[string]bool{},
+	}
+	out, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		return fmt.Errorf("Failed running go env: %w", err)
+	}
+	u.modCache = strings.TrimSpace(string(out))
+	if err := u.load(); err != nil {
+		return err
+	}
+
+	need, err := u.requirements(filteredImports(entries))
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for path := range need {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	have := map[string]string{}
+	for _, req := range u.gomod.Require {
+		have[req.Mod.Path] = req.Mod.Version
+	}
+	for _, path := range paths {
+		version := need[path]
+		if current, ok := have[path]; ok && semver.Compare(current, version) >= 0 {
+			continue
+		}
+		if _, ok := have[path]; ok {
+			err = u.gomod.AddRequire(path, version)
+		} else {
+			u.gomod.AddNewRequire(path, version, true)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Requiring %s %s", path, version)
+		if err := u.addSums(module.Version{Path: path, Version: version}); err != nil {
+			return err
+		}
+	}
+	return u.write()
+}
+
+// load reads the copy's go.mod, go.sum and go.work.
+func (u *goModUpdate) load() error {
+	gomod := filepath.Join(u.workModule, "go.mod")
+	byts, err := os.ReadFile(gomod)
+	if err != nil {
+		return err
+	}
+	if u.gomod, err = modfile.Parse(gomod, byts, nil); err != nil {
+		return err
+	}
+	for _, replace := range u.gomod.Replace {
+		u.replaces[replace.Old.Path] = resolveReplace(u.workModule, replace.New)
+	}
+	if u.workGoWork != "" {
+		byts, err := os.ReadFile(u.workGoWork)
+		if err != nil {
+			return err
+		}
+		work, err := modfile.ParseWork(u.workGoWork, byts, nil)
+		if err != nil {
+			return err
+		}
+		// The workspace's replacements win.
+		for _, replace := range work.Replace {
+			u.replaces[replace.Old.Path] = resolveReplace(filepath.Dir(u.workGoWork), replace.New)
+		}
+	}
+
+	lines, err := readSums(filepath.Join(u.workModule, "go.sum"))
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		u.knownSums[line] = true
+		u.sums[line] = true
+	}
+	return nil
+}
+
+// resolveReplace returns the replacement m, with its path made absolute if
+// it's a directory relative to dir.
+func resolveReplace(dir string, m module.Version) module.Version {
+	if m.Version == "" && !filepath.IsAbs(m.Path) {
+		m.Path = filepath.Join(dir, m.Path)
+	}
+	return m
+}
+
+// filteredImports returns the import paths in the Go files in entries: the
+// registration files and package main stubs that got-reload generated, and
+// the packages' own files, which filtering can add imports to, e.g. of
+// got-reload's generic package, for generic functions.
+func filteredImports(entries []*cache.Entry) []string {
+	fset := token.NewFileSet()
+	seen := map[string]bool{}
+	var imports []string
+	for _, e := range entries {
+		for name, byts := range e.Files {
+			if !strings.HasSuffix(name, ".go") {
+				continue
+			}
+			file, err := parser.ParseFile(fset, name, byts, parser.ImportsOnly)
+			if err != nil {
+				continue
+			}
+			for _, imp := range file.Imports {
+				path, err := strconv.Unquote(imp.Path.Value)
+				if err == nil && !seen[path] {
+					seen[path] = true
+					imports = append(imports, path)
+				}
+			}
+		}
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// requirements returns the modules, with their minimum versions, that
+// provide imports, other than local ones.
+func (u *goModUpdate) requirements(imports []string) (map[string]string, error) {
+	need := map[string]string{}
+	require := func(path, version string) {
+		if current, ok := need[path]; !ok || semver.Compare(current, version) < 0 {
+			need[path] = version
+		}
+	}
+	local := map[string]bool{}
+	for _, pkg := range u.fc.pkgs {
+		if localModule(pkg.Module) {
+			local[pkg.Module.Path] = true
+		}
+	}
+
+	needReloader := false
+	for _, path := range imports {
+		if util.ProbablyStdLib(path) {
+			continue
+		}
+		if path == reloaderModule || strings.HasPrefix(path, reloaderModule+"/") {
+			needReloader = true
+			continue
+		}
+		if pkg := u.fc.pkgs[path]; pkg != nil && pkg.Module != nil {
+			if !localModule(pkg.Module) {
+				require(pkg.Module.Path, pkg.Module.Version)
+			}
+			continue
+		}
+		if !underAny(path, local) {
+			// The generated code only imports the watched packages and
+			// what they import, which "go list" has found.
+			log.Printf("Cannot find the module providing %s", path)
+		}
+	}
+	if !needReloader {
+		return need, nil
+	}
+
+	// got-reload itself, at the version the module already requires, or at
+	// ours.
+	version := ""
+	for _, req := range u.gomod.Require {
+		if req.Mod.Path == reloaderModule {
+			version = req.Mod.Version
+		}
+	}
+	info, _ := debug.ReadBuildInfo()
+	if version == "" {
+		if info == nil || info.Main.Path != reloaderModule || !semver.IsValid(info.Main.Version) {
+			return nil, fmt.Errorf("The module doesn't require %s, and this got-reload's version is unknown; require it in go.mod, or use -go-get", reloaderModule)
+		}
+		version = info.Main.Version
+		if info.Main.Sum != "" {
+			u.knownSums[fmt.Sprintf("%s %s %s", reloaderModule, version, info.Main.Sum)] = true
+		}
+	}
+	require(reloaderModule, version)
+
+	// And what it needs: the modules in its go.mod, but only the ones it's
+	// built with, not the ones only its tests use.
+	gomod, gosum, err := u.moduleFiles(module.Version{Path: reloaderModule, Version: version})
+	if err != nil {
+		return nil, err
+	}
+	file, err := modfile.ParseLax("go.mod", gomod, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s's go.mod: %w", reloaderModule, err)
+	}
+	var linked map[string]bool
+	if info != nil && info.Main.Path == reloaderModule {
+		linked = map[string]bool{}
+		for _, dep := range info.Deps {
+			linked[dep.Path] = true
+			if dep.Sum != "" {
+				u.knownSums[fmt.Sprintf("%s %s %s", dep.Path, dep.Version, dep.Sum)] = true
+			}
+		}
+	}
+	for _, req := range file.Require {
+		if linked == nil || linked[req.Mod.Path] {
+			require(req.Mod.Path, req.Mod.Version)
+		}
+	}
+	for _, line := range strings.Split(string(gosum), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			u.knownSums[line] = true
+		}
+	}
+	// The go command won't use a module that needs a newer Go than the main
+	// module says it's written for.
+	if file.Go != nil && (u.gomod.Go == nil || semver.Compare("v"+file.Go.Version, "v"+u.gomod.Go.Version) > 0) {
+		if err := u.gomod.AddGoStmt(file.Go.Version); err != nil {
+			return nil, err
+		}
+	}
+	return need, nil
+}
+
+// underAny reports whether the import path is in one of the modules.
+func underAny(path string, modules map[string]bool) bool {
+	for mod := range modules {
+		if path == mod || strings.HasPrefix(path, mod+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleFiles returns the go.mod, and go.sum if there is one, of m, or of its
+// replacement: from its directory, or from the module cache.
+func (u *goModUpdate) moduleFiles(m module.Version) (gomod, gosum []byte, err error) {
+	dir := ""
+	if replace, ok := u.replaces[m.Path]; ok {
+		if replace.Version == "" {
+			dir = replace.Path
+		} else {
+			m = replace
+		}
+	}
+	if dir == "" {
+		escPath, err := module.EscapePath(m.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		escVersion, err := module.EscapeVersion(m.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir = filepath.Join(u.modCache, escPath+"@"+escVersion)
+		if _, err := os.Stat(dir); err != nil {
+			// Not extracted; the go.mod may still be downloaded.
+			gomod, err := os.ReadFile(u.cacheFile(m, ".mod"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s@%s isn't in the module cache; download it, or use -go-get", m.Path, m.Version)
+			}
+			return gomod, nil, nil
+		}
+	}
+	gomod, err = os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, nil, err
+	}
+	gosum, err = os.ReadFile(filepath.Join(dir, "go.sum"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	return gomod, gosum, nil
+}
+
+// cacheFile returns the path of m's file with the given suffix in the module
+// cache's download directory, e.g. ".mod" or ".ziphash".
+func (u *goModUpdate) cacheFile(m module.Version, suffix string) string {
+	escPath, _ := module.EscapePath(m.Path)
+	escVersion, _ := module.EscapeVersion(m.Version)
+	return filepath.Join(u.modCache, "cache", "download", escPath, "@v", escVersion+suffix)
+}
+
+// addSums adds the go.sum lines for m's go.mod and content. The go.mod one is
+// required, since the go command reads the go.mod of every module the main
+// module requires; the content one only if m provides packages, which we
+// can't always tell, so its absence is just logged.
+func (u *goModUpdate) addSums(m module.Version) error {
+	if replace, ok := u.replaces[m.Path]; ok && replace.Version == "" {
+		// Directories aren't checksummed.
+		return nil
+	}
+	prefix := m.Path + " " + m.Version + " "
+	modPrefix := m.Path + " " + m.Version + "/go.mod "
+	var zipLine, modLine string
+	for line := range u.knownSums {
+		switch {
+		case strings.HasPrefix(line, prefix):
+			zipLine = line
+		case strings.HasPrefix(line, modPrefix):
+			modLine = line
+		}
+	}
+
+	if modLine == "" {
+		modFile := u.cacheFile(m, ".mod")
+		hash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+			return os.Open(modFile)
+		})
+		if err != nil {
+			return fmt.Errorf("No checksum for %s@%s's go.mod, and it isn't in the module cache; download it, or use -go-get", m.Path, m.Version)
+		}
+		modLine = modPrefix + hash
+	}
+	if zipLine == "" {
+		if hash, err := os.ReadFile(u.cacheFile(m, ".ziphash")); err == nil {
+			zipLine = prefix + strings.TrimSpace(string(hash))
+		} else {
+			log.Printf("No checksum for %s@%s; building may fail if it's needed", m.Path, m.Version)
+		}
+	}
+	u.sums[modLine] = true
+	if zipLine != "" {
+		u.sums[zipLine] = true
+	}
+	return nil
+}
+
+// write writes the copy's go.mod and go.sum.
+func (u *goModUpdate) write() error {
+	// As "go mod tidy" would, for a module that's on Go 1.17 or later.
+	if u.gomod.Go != nil && semver.Compare("v"+u.gomod.Go.Version, "v1.17") >= 0 {
+		u.gomod.SetRequireSeparateIndirect(u.gomod.Require)
+	}
+	u.gomod.Cleanup()
+	byts, err := u.gomod.Format()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(u.workModule, "go.mod"), byts, 0644); err != nil {
+		return err
+	}
+	var lines []string
+	for line := range u.sums {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	return os.WriteFile(filepath.Join(u.workModule, "go.sum"), buf.Bytes(), 0644)
+}
+
+// readSums returns the lines of the go.sum file at path, if there is one.
+func readSums(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
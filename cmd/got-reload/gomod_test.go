@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/got-reload/got-reload/pkg/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/module"
+)
+
+// testGoModUpdate returns a goModUpdate of a copy, in a new directory, of a
+// module with the given go.mod, whose dependencies are pkgs, with an empty
+// module cache.
+func testGoModUpdate(t *testing.T, gomod string, pkgs ...*listedPackage) *goModUpdate {
+	t.Helper()
+	workModule := t.TempDir()
+	writeFile(t, filepath.Join(workModule, "go.mod"), gomod)
+	u := &goModUpdate{
+		workModule: workModule,
+		fc:         &filterCache{pkgs: map[string]*listedPackage{}},
+		replaces:   map[string]module.Version{},
+		knownSums:  map[string]bool{},
+		sums:       map[string]bool{},
+		modCache:   t.TempDir(),
+	}
+	for _, pkg := range pkgs {
+		u.fc.pkgs[pkg.ImportPath] = pkg
+	}
+	require.NoError(t, u.load())
+	return u
+}
+
+// writeCacheFile writes m's file with the given suffix into u's module cache.
+func writeCacheFile(t *testing.T, u *goModUpdate, m module.Version, suffix, content string) {
+	t.Helper()
+	writeFile(t, u.cacheFile(m, suffix), content)
+}
+
+func TestRequirements(t *testing.T) {
+	pkgs := []*listedPackage{
+		{ImportPath: "example.org/x/p", Module: &listedModule{Path: "example.org/x", Version: "v1.2.0"}},
+		{ImportPath: "example.org/x/q", Module: &listedModule{Path: "example.org/x", Version: "v1.2.0"}},
+		{ImportPath: "example.com/m/a", Module: &listedModule{Path: "example.com/m", Main: true}},
+		{ImportPath: "example.org/local/b", Module: &listedModule{Path: "example.org/local", Replace: &listedModule{Path: "../local"}}},
+	}
+	tests := []struct {
+		name    string
+		imports []string
+		want    map[string]string
+	}{
+		{"none", nil, map[string]string{}},
+		{"standard library", []string{"fmt", "net/http"}, map[string]string{}},
+		{"dependency", []string{"example.org/x/p", "example.org/x/q"}, map[string]string{"example.org/x": "v1.2.0"}},
+		{"local modules", []string{"example.com/m/a", "example.org/local/b", "example.org/local/unlisted"}, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := testGoModUpdate(t, "module example.com/m\n\ngo 1.22\n", pkgs...)
+			need, err := u.requirements(test.imports)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, need)
+		})
+	}
+}
+
+func TestRequirementsReloader(t *testing.T) {
+	u := testGoModUpdate(t, "module example.com/m\n\ngo 1.21\n\nrequire "+reloaderModule+" v0.1.0\n")
+	reloader := module.Version{Path: reloaderModule, Version: "v0.1.0"}
+	escPath, err := module.EscapePath(reloader.Path)
+	require.NoError(t, err)
+	// golang.org/x/mod is linked into got-reload; example.org/testonly isn't.
+	writeFile(t, filepath.Join(u.modCache, escPath+"@v0.1.0", "go.mod"),
+		"module "+reloaderModule+"\n\ngo 1.22.1\n\nrequire (\n\tgolang.org/x/mod v0.1.0\n\texample.org/testonly v1.0.0\n)\n")
+	writeFile(t, filepath.Join(u.modCache, escPath+"@v0.1.0", "go.sum"), "golang.org/x/mod v0.1.0/go.mod h1:modsum=\n")
+
+	need, err := u.requirements([]string{reloaderPkg, "fmt"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{reloaderModule: "v0.1.0", "golang.org/x/mod": "v0.1.0"}, need)
+	assert.True(t, u.knownSums["golang.org/x/mod v0.1.0/go.mod h1:modsum="], "sums from got-reload's go.sum")
+	assert.Equal(t, "1.22.1", u.gomod.Go.Version, "go version raised to got-reload's")
+}
+
+func TestAddSums(t *testing.T) {
+	m := module.Version{Path: "example.org/x", Version: "v1.2.0"}
+	tests := []struct {
+		name                string
+		gosum, mod, ziphash string
+		replace             string
+		want                []string
+		wantErr             bool
+	}{
+		{
+			name:  "known",
+			gosum: "example.org/x v1.2.0 h1:zip=\nexample.org/x v1.2.0/go.mod h1:mod=\n",
+			want:  []string{"example.org/x v1.2.0 h1:zip=", "example.org/x v1.2.0/go.mod h1:mod="},
+		},
+		{
+			name:    "module cache",
+			mod:     "module example.org/x\n",
+			ziphash: "h1:zip=\n",
+			want:    []string{"example.org/x v1.2.0 h1:zip=", "example.org/x v1.2.0/go.mod h1:ttZ6STTSw02wpifl36C4ykrixVCfiT3NnM0FC8UBrvg="},
+		},
+		{
+			name: "no content checksum",
+			mod:  "module example.org/x\n",
+			want: []string{"example.org/x v1.2.0/go.mod h1:ttZ6STTSw02wpifl36C4ykrixVCfiT3NnM0FC8UBrvg="},
+		},
+		{
+			name:    "no go.mod checksum",
+			wantErr: true,
+		},
+		{
+			name:    "directory replacement",
+			replace: "replace example.org/x => ../x\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := testGoModUpdate(t, "module example.com/m\n\ngo 1.22\n"+test.replace)
+			for _, line := range strings.Split(test.gosum, "\n") {
+				if line != "" {
+					u.knownSums[line] = true
+				}
+			}
+			if test.mod != "" {
+				writeCacheFile(t, u, m, ".mod", test.mod)
+			}
+			if test.ziphash != "" {
+				writeCacheFile(t, u, m, ".ziphash", test.ziphash)
+			}
+
+			err := u.addSums(m)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var sums []string
+			for line := range u.sums {
+				sums = append(sums, line)
+			}
+			assert.ElementsMatch(t, test.want, sums)
+		})
+	}
+}
+
+func TestUpdateGoMod(t *testing.T) {
+	t.Setenv("GOMODCACHE", t.TempDir())
+	workModule := t.TempDir()
+	writeFile(t, filepath.Join(workModule, "go.mod"), "module example.com/m\n\ngo 1.22\n\nrequire (\n\texample.org/x v1.3.0\n\texample.org/y v1.0.0\n)\n")
+	writeFile(t, filepath.Join(workModule, "go.sum"), "example.org/old v1.0.0/go.mod h1:old=\n")
+	fc := &filterCache{pkgs: map[string]*listedPackage{}}
+	for _, pkg := range []*listedPackage{
+		{ImportPath: "example.org/x/p", Module: &listedModule{Path: "example.org/x", Version: "v1.2.0"}},
+		{ImportPath: "example.org/y/p", Module: &listedModule{Path: "example.org/y", Version: "v1.1.0"}},
+		{ImportPath: "example.org/z/p", Module: &listedModule{Path: "example.org/z", Version: "v0.5.0"}},
+	} {
+		fc.pkgs[pkg.ImportPath] = pkg
+	}
+	u := &goModUpdate{modCache: os.Getenv("GOMODCACHE")}
+	for _, m := range []module.Version{{Path: "example.org/y", Version: "v1.1.0"}, {Path: "example.org/z", Version: "v0.5.0"}} {
+		writeCacheFile(t, u, m, ".mod", "module "+m.Path+"\n")
+		writeCacheFile(t, u, m, ".ziphash", "h1:"+m.Version+"=\n")
+	}
+
+	entries := []*cache.Entry{{Files: map[string][]byte{
+		"a/a.go":     []byte("package a\n\nimport (\n\t\"fmt\"\n\t\"example.org/x/p\"\n\t\"example.org/y/p\"\n)\n"),
+		"a/grl_z.go": []byte("package a\n\nimport \"example.org/z/p\"\n"),
+		"a/data.txt": []byte("import \"example.org/ignored\"\n"),
+	}}}
+	require.NoError(t, updateGoMod(workModule, "", fc, entries))
+
+	gomod, err := os.ReadFile(filepath.Join(workModule, "go.mod"))
+	require.NoError(t, err)
+	assert.Equal(t, "module example.com/m\n\ngo 1.22\n\nrequire (\n\texample.org/x v1.3.0\n\texample.org/y v1.1.0\n)\n\nrequire example.org/z v0.5.0 // indirect\n", string(gomod),
+		"x isn't downgraded, y is upgraded, z is added")
+	gosum, err := os.ReadFile(filepath.Join(workModule, "go.sum"))
+	require.NoError(t, err)
+	assert.Contains(t, string(gosum), "example.org/old v1.0.0/go.mod h1:old=\n")
+	assert.Contains(t, string(gosum), "example.org/y v1.1.0 h1:v1.1.0=\n")
+	assert.Contains(t, string(gosum), "example.org/z v0.5.0 h1:v0.5.0=\n")
+	assert.Contains(t, string(gosum), "example.org/z v0.5.0/go.mod h1:")
+	assert.NotContains(t, string(gosum), "example.org/x v1.2.0")
+}
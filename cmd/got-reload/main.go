@@ -2,39 +2,66 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/got-reload/got-reload/pkg/cache"
 	"github.com/got-reload/got-reload/pkg/dup"
-	"github.com/got-reload/got-reload/pkg/extract"
 	"github.com/got-reload/got-reload/pkg/gotreload"
 	"github.com/got-reload/got-reload/pkg/reloader"
-	"github.com/got-reload/got-reload/pkg/util"
-	"golang.org/x/tools/go/packages"
+	"github.com/got-reload/got-reload/pkg/reloader/listen"
+	"github.com/got-reload/got-reload/pkg/workdir"
 )
 
+// ExitCode is got-reload's exit status when it fails itself. Otherwise,
+// "run" and "test" exit with the status of the program or "go test": the same
+// code, or, if it was killed by a signal, 128 plus the signal's number, as
+// shells report it. got-reload exits that way too if it's killed by a signal
+// when there's nothing to pass it on to.
 type ExitCode int
 
 const (
-	Success ExitCode = iota
-	FailedOpenSrc
-	FailedOpenDest
-	FailedCloseDest
-	FailedRead
-	FailedWrite
-	FailedParse
-	FailedTruncate
-	FailedCleanup
+	Success ExitCode = 0
+	// Anything not listed below.
+	Failed ExitCode = 1
+	// Bad flags, arguments or config, as for the flag package.
+	FailedUsage ExitCode = 2
+	// Creating or clearing the work directory.
+	FailedWorkDir ExitCode = 120
+	// Copying the source to the work directory.
+	FailedCopy ExitCode = 121
+	// Filtering the copy.
+	FailedFilter ExitCode = 122
+	// Building the filtered program, before it first runs.
+	FailedBuild ExitCode = 123
 )
 
+// exitf logs a message, as log.Fatalf does, and exits with code.
+func exitf(code ExitCode, format string, v ...any) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	os.Exit(int(code))
+}
+
 var FilterUsage string = `%[1]s filter -out <dir> package [package ...]
 
-Filter the given packages, and write them to directory tree specified by -out.
+Filter the given packages, and write them to directory tree specified by -out,
+along with a grl_manifest.json for each, mapping the original identifiers to
+the rewritten ones. Unchanged packages are restored from the cache in
+$GOT_RELOAD_CACHE (default: got-reload in the user cache directory; "off"
+disables it).
 `
 
 func indexOf(target string, input []string) int {
@@ -93,52 +120,307 @@ func runAsSubprocess(version string, command []string, logIt bool) error {
 const (
 	subcommandRun    = "run"
 	subcommandFilter = "filter"
+	subcommandCheck  = "check"
+	subcommandBuild  = "build"
+	subcommandTest   = "test"
+	subcommandLs     = "ls"
+	subcommandClean  = "clean"
 )
 
 var subcommands = map[string]func(selfName string, args []string){
 	subcommandRun:    run,
 	subcommandFilter: filter,
+	subcommandCheck:  check,
+	subcommandBuild:  build,
+	subcommandTest:   test,
+	subcommandLs:     ls,
+	subcommandClean:  clean,
+}
+
+// sessionFlags are the flags shared by "run" and "build". Those given on the
+// command line override the config file.
+type sessionFlags struct {
+	packagesCSV string
+	verbose     bool
+	useDir      string
+	buildFlags  string
+	debounce    string
+	configPath  string
+	goGet       bool
+	keep        bool
+	// Repeatable; given at all, they replace the config file's lists.
+	excludeFiles stringList
+	excludeFuncs stringList
+}
+
+func (f *sessionFlags) register(set *flag.FlagSet) {
+	set.StringVar(&f.packagesCSV, "pkgs", "", "The comma-delimited list of packages or patterns to enable for hot reload (default: discover them)")
+	set.StringVar(&f.packagesCSV, "p", "", "Short form of \"-pkgs\"")
+	set.BoolVar(&f.verbose, "v", false, "Pass -v to \"go build\" command")
+	set.StringVar(&f.useDir, "dir", "", "The directory to use instead of $TMPDIR/got-reload-*, cleared if an earlier session used it")
+	set.StringVar(&f.useDir, "d", "", "Short form of \"-dir\"")
+	set.StringVar(&f.buildFlags, "build-flags", "", "Space-separated flags for loading and building the program, e.g. \"-tags=dev -race\"")
+	set.StringVar(&f.debounce, "debounce", "", "How long to wait after a change for more changes before reloading (default 100ms)")
+	set.StringVar(&f.configPath, "config", "", "The config file to use instead of "+ConfigFileName+" at the module root")
+	set.BoolVar(&f.goGet, "go-get", false, "Update the work dir's go.mod with \"go get\", which may use the network, instead of offline")
+	set.BoolVar(&f.keep, "keep", false, "Keep the temporary work dir when done")
+	registerExcludes(set, &f.excludeFiles, &f.excludeFuncs)
+}
+
+// registerExcludes registers the flags for the exclusion rules.
+func registerExcludes(set *flag.FlagSet, files, funcs *stringList) {
+	set.Var(files, "exclude-file", "A glob pattern for files whose functions should not be stubbed (repeatable)")
+	set.Var(funcs, "exclude-func", "A regular expression for functions that should not be stubbed (repeatable)")
+}
+
+// config loads the config file, and overrides it with the flags that were
+// set on the command line and with mainPkg, if it's not empty. It also
+// returns the module root. If needMain is set, it's an error for there to be
+// no main package, and the watched packages are resolved (see
+// resolvePackages) relative to it.
+func (f *sessionFlags) config(set *flag.FlagSet, mainPkg string, needMain bool) (*Config, string) {
+	setFlags := map[string]bool{}
+	set.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	moduleRoot, err := mainModuleRoot()
+	if err != nil {
+		log.Fatalf("Unable to find module root: %v", err)
+	}
+	cfg, err := loadConfig(f.configPath, moduleRoot)
+	if err != nil {
+		exitf(FailedUsage, "%v", err)
+	}
+	if setFlags["pkgs"] || setFlags["p"] {
+		cfg.Packages = strings.Split(f.packagesCSV, ",")
+	}
+	if setFlags["dir"] || setFlags["d"] {
+		cfg.Dir = f.useDir
+	}
+	if setFlags["v"] {
+		cfg.Verbose = f.verbose
+	}
+	if setFlags["build-flags"] {
+		cfg.BuildFlags = strings.Fields(f.buildFlags)
+	}
+	if setFlags["debounce"] {
+		cfg.Debounce = f.debounce
+	}
+	if setFlags["go-get"] {
+		cfg.GoGet = f.goGet
+	}
+	if setFlags["keep"] {
+		cfg.Keep = f.keep
+	}
+	if setFlags["exclude-file"] {
+		cfg.ExcludeFiles = f.excludeFiles
+	}
+	if setFlags["exclude-func"] {
+		cfg.ExcludeFuncs = f.excludeFuncs
+	}
+	if mainPkg != "" {
+		cfg.Main = mainPkg
+	}
+	if err := cfg.validate(); err != nil {
+		exitf(FailedUsage, "%v", err)
+	}
+
+	if needMain {
+		if cfg.Main == "" {
+			exitf(FailedUsage, "No main package specified; give one as an argument or in %s", ConfigFileName)
+		}
+		if err := cfg.resolvePackages([]string{cfg.Main}, false); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	return cfg, moduleRoot
 }
 
 func run(selfName string, args []string) {
-	var packagesCSV string
-	var verbose bool
-	var useDir string
-	// var keep bool
+	var flags sessionFlags
+	var restart bool
+	var listenCSV string
 
 	set := flag.NewFlagSet(selfName, flag.ExitOnError)
-	// set.BoolVar(&keep, "keep", false, "Keep all the filtered code")    // currently ignored
-	set.StringVar(&packagesCSV, "pkgs", "", "The comma-delimited list of packages to enable for hot reload")
-	set.StringVar(&packagesCSV, "p", "", "Short form of \"-pkgs\"")
-	set.BoolVar(&verbose, "v", false, "Pass -v to \"go run\" command")
-	set.StringVar(&useDir, "dir", "", "The directory to use instead of $TMPDIR/gotreload-*")
-	set.StringVar(&useDir, "d", "", "Short form of \"-dir\"")
+	flags.register(set)
+	set.BoolVar(&restart, "restart", true, "Rebuild and restart the program when a change cannot be hot-reloaded")
+	set.StringVar(&listenCSV, "listen", "", "A comma-delimited list of TCP addresses to keep listening on across restarts")
 	set.Usage = func() {
 		out := flag.CommandLine.Output()
 		fmt.Fprintf(out, `%[1]s
 
-%[1]s [flags] <package> <cmd-args>
+%[1]s [flags] [<package> [<cmd-args>]]
 
 Flags:
 
 `, selfName)
 		set.PrintDefaults()
 		fmt.Fprintf(out, `
--dir/-d - If you specify this option, it's up to you to clean up the directory
-			 before each use. We are wary of running the equivalent of "rm -rf
-			 $dir/*" ourselves.
+-dir/-d - got-reload marks the directories it uses, and only clears one
+			 that it marked, and that no running session is using. It won't
+			 touch a directory with anything else in it. Unlike a temporary
+			 directory, it's kept when the session ends.
+
+-config - Any flags and arguments you give override the corresponding settings
+			 in the config file. See the Config type in config.go for the format.
+
+-listen - got-reload opens these listeners itself and passes them to each
+			 instance of your program. Get them with listen.Listen from
+			 github.com/got-reload/got-reload/pkg/reloader/listen, using the same
+			 address string.
+
+SIGINT, SIGTERM and SIGHUP are passed on to the program, and got-reload exits
+with its exit status. If it fails before the program runs, it exits with 2 for
+bad flags, arguments or config, 120 if it can't set up the work dir, 121 if it
+can't copy the source there, 122 if it can't filter it, 123 if it can't build
+it, and 1 otherwise.
 `)
 	}
 	if err := set.Parse(args); err != nil {
 		set.Usage()
 		os.Exit(1)
 	}
-	runPackage := set.Arg(0)
+	cfg, moduleRoot := flags.config(set, set.Arg(0), true)
+	set.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "restart":
+			cfg.Restart = &restart
+		case "listen":
+			cfg.Listen = strings.Split(listenCSV, ",")
+		}
+	})
+	if set.NArg() > 1 {
+		cfg.Args = set.Args()[1:]
+	}
+	restart = cfg.Restart == nil || *cfg.Restart
+
+	s := newSession(cfg, moduleRoot, false)
+	env, err := s.reloaderEnv()
+	if err != nil {
+		s.exitf(Failed, "%v", err)
+	}
+	for key, val := range env {
+		os.Setenv(key, val)
+	}
+
+	restartFile := filepath.Join(s.grlDir, "restart")
+	if restart {
+		os.Setenv(reloader.RestartFileEnv, restartFile)
+	}
+	// A reused work dir may have one left over.
+	os.Remove(restartFile)
+
+	listeners, err := openListeners(cfg.Listen)
+	if err != nil {
+		s.exitf(Failed, "%v", err)
+	}
+	if len(listeners) > 0 {
+		os.Setenv(listen.Env, strings.Join(cfg.Listen, ","))
+	}
+
+	for _, v := range os.Environ() {
+		if strings.Contains(v, "GOT") {
+			log.Println(v)
+		}
+	}
+
+	binPath := filepath.Join(s.grlDir, "bin", filepath.Base(s.mainPath))
+	if err := s.build(binPath); err != nil {
+		s.exitf(FailedBuild, "Failed building %s: %v", s.mainPath, err)
+	}
+
+	for {
+		cmd := exec.Command(binPath, cfg.Args...)
+		cmd.Env = cfg.environ(s.goEnv())
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.ExtraFiles = listeners
+		err := s.runChild(cmd)
+
+		var exitErr *exec.ExitError
+		if !restart || !errors.As(err, &exitErr) || exitErr.ExitCode() != reloader.RestartExitCode {
+			s.exitChild(s.mainPath, err)
+		}
 
-	packages := strings.Split(packagesCSV, ",")
-	if len(packages) < 1 {
-		log.Fatal("No got-reload packages specified")
+		// The program may exit with RestartExitCode on its own; it's only a
+		// restart if the reloader wrote the restart file.
+		byts, readErr := os.ReadFile(restartFile)
+		if errors.Is(readErr, fs.ErrNotExist) {
+			s.exitChild(s.mainPath, err)
+		}
+		if readErr != nil {
+			s.exitf(Failed, "Failed reading restart file: %v", readErr)
+		}
+		os.Remove(restartFile)
+		changedPkgs := strings.Fields(string(byts))
+		log.Printf("Rebuilding %s for changes in %v", s.mainPath, changedPkgs)
+
+		// Keep trying until the changed code builds, so that a typo doesn't
+		// end the session.
+		for {
+			err := s.refilter(changedPkgs)
+			if err == nil {
+				err = s.build(binPath)
+			}
+			if err == nil {
+				break
+			}
+			log.Printf("Failed rebuilding %s: %v", s.mainPath, err)
+			log.Printf("Waiting for changes to %v", changedPkgs)
+			if err := waitForChange(s.goEnv(), changedPkgs); err != nil {
+				s.exitf(Failed, "%v", err)
+			}
+		}
 	}
+}
+
+// A session is a filtered copy of the main module in a work directory, ready
+// to build.
+type session struct {
+	cfg *Config
+	// The got-reload executable, for running "filter".
+	absExecutable string
+	workDir       string
+	// The session recorded in workDir's marker.
+	work *workdir.Session
+	// The command that's running, if any, to pass signals on to: the
+	// program or "go test", or one of our tools. Once a tool is signaled,
+	// we exit as soon as it does.
+	childMu   sync.Mutex
+	child     *exec.Cmd
+	childTool bool
+	signaled  os.Signal
+	// got-reload's own files in the work dir go here. The leading "." keeps
+	// the go command from treating it as part of the module.
+	grlDir string
+	// The main package's source directory and import path. Empty for
+	// "test", which has no main package.
+	fsMainPath string
+	mainPath   string
+	// The root of the original main module, the roots of all the local
+	// modules that are copied, including it, and the go.work file in use,
+	// if any.
+	moduleRoot string
+	modules    []string
+	goWork     string
+	// The directory that workDir is a copy of: the common ancestor of
+	// modules and goWork. The copy of moduleRoot is workModule.
+	srcRoot    string
+	workModule string
+	// Whether dependencies come from the vendor directory, and, if so, the
+	// environment variables that make the go command use it and never the
+	// network, in the tools we run and in the program's reloader.
+	vendor    bool
+	vendorEnv map[string]string
+	// Whether to filter the watched packages' _test.go files too.
+	tests bool
+}
+
+// newSession copies the module at moduleRoot, and any other local modules
+// with watched packages, into a work directory, laid out as the originals are
+// relative to each other, and filters the watched packages there.
+func newSession(cfg *Config, moduleRoot string, tests bool) *session {
+	s := &session{cfg: cfg, moduleRoot: moduleRoot, tests: tests}
 
 	// This is either "got-reload" or whatever executable "go run" builds.  (I
 	// mention this in part because if you search the source for "got-reload" I
@@ -154,71 +436,319 @@ Flags:
 		log.Printf("Unable to derive absolute path for %s, using relative path and hoping for the best: %v", os.Args[0], err)
 		absExecutable = os.Args[0]
 	}
+	s.absExecutable = absExecutable
 
-	var workDir string
-	if useDir == "" {
-		workDir, err = os.MkdirTemp("", "got-reload-*")
-		if err != nil {
-			log.Fatalf("Unable to create work directory: %v", err)
+	s.modules, err = localModules(moduleRoot, cfg.Packages, cfg.BuildFlags)
+	if err != nil {
+		exitf(Failed, "%v", err)
+	}
+	if cfg.Dir != "" {
+		if err := checkWorkDir(cfg.Dir, s.modules); err != nil {
+			exitf(FailedUsage, "%v", err)
 		}
+	}
+
+	if cfg.Dir == "" {
+		s.work, err = workdir.Create(moduleRoot)
 	} else {
-		workDir = useDir
+		s.work, err = workdir.Prepare(cfg.Dir, moduleRoot)
+	}
+	if err != nil {
+		exitf(FailedWorkDir, "%v", err)
 	}
+	s.workDir = s.work.Dir
+	s.handleSignals()
 
-	// - copy entire local module into temporary directory using dup.Copy
-	path, err := goListSingle("-m", "-f", "{{.Dir}}")
+	s.goWork, err = goWork(moduleRoot)
 	if err != nil {
-		log.Fatalf("Unable to find module root: %v", err)
+		s.exitf(Failed, "Unable to find the workspace file: %v", err)
 	}
-	log.Printf("copying %s to %s", path, workDir)
-	if err := dup.Copy(workDir, os.DirFS(path)); err != nil {
-		log.Fatalf("Failed copying files to working dir: %v", err)
+	vendorDir := moduleRoot
+	if s.goWork != "" {
+		vendorDir = filepath.Dir(s.goWork)
 	}
-	// - invoke filter command on that copy
-	cmdArgs := append([]string{"filter", "-dir", workDir}, packages...)
-	if err := runWithIO(absExecutable, cmdArgs...); err != nil {
-		log.Fatalf("Failed rewriting code: %v", err)
-	}
-	// - invoke go run on the filtered codebase
-	os.Setenv(reloader.PackageListEnv, packagesCSV)
-	os.Setenv(reloader.StartReloaderEnv, "1")
-	paths, err := goListSingle("-f", "{{.Dir}} {{.ImportPath}}", runPackage)
+	s.vendor, err = vendorMode(vendorDir, cfg.BuildFlags)
 	if err != nil {
-		log.Fatalf("Could not resolve main package %s: %v", runPackage, err)
+		s.exitf(Failed, "Unable to tell whether dependencies are vendored: %v", err)
+	}
+	if s.vendor {
+		log.Printf("Using vendored dependencies")
+		goFlags := os.Getenv("GOFLAGS")
+		if modFlag(strings.Fields(goFlags)) != "vendor" {
+			goFlags = strings.TrimSpace(goFlags + " -mod=vendor")
+		}
+		s.vendorEnv = map[string]string{
+			"GOFLAGS": goFlags,
+			"GOPROXY": "off",
+		}
+	}
+	s.srcRoot = commonRoot(s.modules...)
+	if s.goWork != "" {
+		s.srcRoot = commonRoot(s.srcRoot, filepath.Dir(s.goWork))
 	}
-	fsMainPath := strings.Fields(paths)[0]
-	mainPath := strings.Fields(paths)[1]
-	os.Setenv(reloader.SourceDirEnv, fsMainPath)
+	s.workModule = filepath.Join(s.workDir, strings.TrimPrefix(moduleRoot, s.srcRoot))
 
-	for _, v := range os.Environ() {
-		if strings.Contains(v, "GOT") {
-			log.Println(v)
+	// - copy entire local modules into temporary directory using dup.Copy
+	for _, module := range s.modules {
+		dest := filepath.Join(s.workDir, strings.TrimPrefix(module, s.srcRoot))
+		log.Printf("copying %s to %s", module, dest)
+		if err := dup.Copy(dest, os.DirFS(module)); err != nil {
+			s.exitf(FailedCopy, "Failed copying files to working dir: %v", err)
 		}
 	}
+	// - invoke filter command on that copy
+	if err := s.refilter(cfg.Packages); err != nil {
+		s.exitf(FailedFilter, "Failed rewriting code: %v", err)
+	}
 
-	// rewriting can change the set of directly-imported symbols within the
-	// packages, so we need to update go.mod so that things still compile.
-	if err := runWithIOIn(workDir, "go", "get", "./..."); err != nil {
-		log.Fatalf("Failed running go get ./...: %v", err)
+	if cfg.Main != "" {
+		paths, err := goListSingle(s.goEnv(), "-f", "{{.Dir}} {{.ImportPath}}", cfg.Main)
+		if err != nil {
+			s.exitf(Failed, "Could not resolve main package %s: %v", cfg.Main, err)
+		}
+		s.fsMainPath = strings.Fields(paths)[0]
+		s.mainPath = strings.Fields(paths)[1]
+	}
+
+	s.grlDir = filepath.Join(s.workDir, workdir.MarkerDir)
+	if err := os.MkdirAll(s.grlDir, 0755); err != nil {
+		s.exitf(Failed, "Unable to create %s: %v", s.grlDir, err)
+	}
+	return s
+}
+
+// close removes the work dir, if it's a temporary one that we weren't asked
+// to keep.
+func (s *session) close() {
+	if !s.work.Temp {
+		return
+	}
+	if s.cfg.Keep {
+		log.Printf("Keeping %s", s.workDir)
+		return
+	}
+	if err := s.work.Remove(); err != nil {
+		log.Printf("Unable to remove work directory: %v", err)
+	}
+}
+
+// reloaderEnv returns the environment variables the reloader needs in the
+// program to find and rewrite the watched packages. The program also needs
+// s.vendorEnv (see goEnv), to load them as it was built.
+func (s *session) reloaderEnv() (map[string]string, error) {
+	env := map[string]string{
+		reloader.PackageListEnv:   strings.Join(s.cfg.Packages, ","),
+		reloader.StartReloaderEnv: "1",
+		reloader.SourceDirEnv:     s.fsMainPath,
+		reloader.WorkDirEnv:       s.workDir,
+		reloader.SourceRootEnv:    s.srcRoot,
+	}
+	if s.tests {
+		// "go test" runs test binaries in the (filtered) package's
+		// directory, so tell the reloader where the real source is.
+		env[reloader.SourceDirEnv] = s.moduleRoot
+		env[reloader.TestsEnv] = "1"
+	}
+	if s.cfg.Debounce != "" {
+		env[reloader.DebounceEnv] = s.cfg.Debounce
+	}
+	for key, list := range map[string][]string{
+		reloader.ExcludeFilesEnv: s.cfg.ExcludeFiles,
+		reloader.ExcludeFuncsEnv: s.cfg.ExcludeFuncs,
+		reloader.BuildFlagsEnv:   s.cfg.BuildFlags,
+	} {
+		if len(list) == 0 {
+			continue
+		}
+		byts, err := json.Marshal(list)
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding $%s: %w", key, err)
+		}
+		env[key] = string(byts)
+	}
+	return env, nil
+}
+
+// goEnv returns the environment for the tools we run, and the program's
+// base one: ours, plus s.vendorEnv, which is never set in ours.
+func (s *session) goEnv() []string {
+	env := os.Environ()
+	for key, val := range s.vendorEnv {
+		env = append(env, key+"="+val)
+	}
+	return env
+}
+
+// build builds the filtered main package to binPath.
+func (s *session) build(binPath string) error {
+	buildArgs := []string{"build"}
+	if s.cfg.Verbose {
+		buildArgs = append(buildArgs, "-v")
+	}
+	buildArgs = append(buildArgs, s.cfg.BuildFlags...)
+	buildArgs = append(buildArgs, "-o", binPath, s.mainPath)
+	cmd := exec.Command("go", buildArgs...)
+	cmd.Dir = s.workModule
+	cmd.Env = s.goEnv()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	stderr := s.diagWriter(cmd.Dir)
+	cmd.Stderr = stderr
+	err := s.runTool(cmd)
+	stderr.Close()
+	return err
+}
+
+// diagWriter returns a writer to stderr that translates the diagnostics of a
+// go command run in dir, in the work dir, into terms of the original source.
+func (s *session) diagWriter(dir string) io.WriteCloser {
+	return gotreload.NewDiagTranslator(s.workDir, s.srcRoot, dir).Writer(os.Stderr)
+}
+
+// refilter runs the filter on pkgs, writing to the work dir, and then
+// updates the work dir's go.mod to match.
+func (s *session) refilter(pkgs []string) error {
+	cmdArgs := []string{"filter", "-dir", s.workDir, "-src", s.srcRoot}
+	for _, module := range s.modules {
+		cmdArgs = append(cmdArgs, "-module", module)
+	}
+	if s.goWork != "" {
+		cmdArgs = append(cmdArgs, "-work", s.goWork)
+	}
+	if s.tests {
+		cmdArgs = append(cmdArgs, "-test")
+	}
+	if s.vendor || s.cfg.GoGet {
+		cmdArgs = append(cmdArgs, "-go-mod=false")
+	}
+	for _, flag := range s.cfg.BuildFlags {
+		cmdArgs = append(cmdArgs, "-build-flag", flag)
+	}
+	for _, pattern := range s.cfg.ExcludeFiles {
+		cmdArgs = append(cmdArgs, "-exclude-file", pattern)
+	}
+	for _, expr := range s.cfg.ExcludeFuncs {
+		cmdArgs = append(cmdArgs, "-exclude-func", expr)
+	}
+	cmdArgs = append(cmdArgs, pkgs...)
+	// Run the filter in the main module, so that it sees the packages as
+	// the go command does when building.
+	if err := s.runIn(s.moduleRoot, s.absExecutable, cmdArgs...); err != nil {
+		return err
+	}
+
+	// The generated code imports got-reload and the packages whose symbols
+	// it registers, so go.mod has to require their modules. The filter
+	// works that out from what's already in the module cache...
+	if s.vendor {
+		// ... unless we'd have to change vendor/ too, in which case it's
+		// up to the user...
+		return s.checkVendored()
+	}
+	if !s.cfg.GoGet {
+		return nil
+	}
+	// ... or, if asked to, the go command does, possibly downloading
+	// modules, and upgrading others.
+	if s.goWork != "" {
+		// "go get ./..." would try to download the other workspace modules.
+		// Their requirements are shared, so it's enough for the main
+		// module to require got-reload.
+		cmd := exec.Command("go", "list", "-m", reloaderModule)
+		cmd.Dir = s.workModule
+		cmd.Env = s.goEnv()
+		if err := cmd.Run(); err == nil {
+			return nil
+		}
+		if err := s.runIn(s.workModule, "go", "get", reloaderPkg); err != nil {
+			return fmt.Errorf("Failed running go get %s: %w", reloaderPkg, err)
+		}
+		return nil
+	}
+	getArgs := append([]string{"get"}, s.cfg.BuildFlags...)
+	if s.tests {
+		getArgs = append(getArgs, "-t")
+	}
+	if err := s.runIn(s.workModule, "go", append(getArgs, "./...")...); err != nil {
+		return fmt.Errorf("Failed running go get ./...: %w", err)
 	}
 	// The above "go get" seems to take care of this?
 	// if err := runWithIOIn(workDir, "go", "mod", "tidy"); err != nil {
 	// 	log.Fatalf("Failed running go mod tidy: %v", err)
 	// }
-	runArgs := []string{"run"}
-	if verbose {
-		runArgs = append(runArgs, "-v")
+	return nil
+}
+
+// checkVendored returns an error if the filtered code imports any packages
+// that aren't vendored: got-reload's own, if the module doesn't vendor them.
+func (s *session) checkVendored() error {
+	errs, err := unvendoredImports(s.workModule, []string{"./..."}, s.cfg.BuildFlags, s.tests)
+	if err != nil {
+		return err
 	}
-	runArgs = append(runArgs, string(mainPath))
-	runArgs = append(runArgs, set.Args()[1:]...)
-	if err := runWithIOIn(workDir, "go", runArgs...); err != nil {
-		log.Fatalf("Failed running go run: %v", err)
+	if len(errs) == 0 {
+		return nil
 	}
+	return fmt.Errorf(`Filtered code needs packages that aren't vendored:
+	%s
+Vendor %s, e.g. by importing it from a file with a "//go:build tools" line,
+and run "go mod vendor"`, strings.Join(errs, "\n\t"), reloaderPkg)
 }
 
-func goListSingle(flags ...string) (string, error) {
+// openListeners listens on each of the TCP addresses in addrs, and returns
+// the listeners' files, in order, for passing to the program.
+func openListeners(addrs []string) ([]*os.File, error) {
+	var files []*os.File
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to listen on %s: %w", addr, err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get file for listener on %s: %w", addr, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// waitForChange blocks until a file in one of pkgs' source directories
+// changes. env is the environment to run the go command in.
+func waitForChange(env []string, pkgs []string) error {
+	dirs, err := goListSingle(env, append([]string{"-f", "{{.Dir}}"}, pkgs...)...)
+	if err != nil {
+		return fmt.Errorf("Unable to find directories for %v: %w", pkgs, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for _, dir := range strings.Fields(dirs) {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case event := <-watcher.Events:
+			if event.Op&(fsnotify.Create|fsnotify.Rename|fsnotify.Write) > 0 &&
+				strings.HasSuffix(event.Name, ".go") {
+
+				return nil
+			}
+		case err := <-watcher.Errors:
+			return err
+		}
+	}
+}
+
+func goListSingle(env []string, flags ...string) (string, error) {
 	args := append([]string{"list"}, flags...)
-	mainPath, err := exec.Command("go", args...).Output()
+	cmd := exec.Command("go", args...)
+	cmd.Env = env
+	mainPath, err := cmd.Output()
 	if err != nil {
 		return "", err
 	}
@@ -226,17 +756,16 @@ func goListSingle(flags ...string) (string, error) {
 	return out, nil
 }
 
-func runWithIO(cmd string, args ...string) error {
-	return runWithIOIn("", cmd, args...)
-}
-
-func runWithIOIn(dir, cmd string, args ...string) error {
+// runIn runs one of our tools (got-reload itself, or the go command) in dir,
+// with our stdio.
+func (s *session) runIn(dir, cmd string, args ...string) error {
 	runCmd := exec.Command(cmd, args...)
 	runCmd.Dir = dir
+	runCmd.Env = s.goEnv()
 	runCmd.Stdin = os.Stdin
 	runCmd.Stdout = os.Stdout
 	runCmd.Stderr = os.Stderr
-	return runCmd.Run()
+	return s.runTool(runCmd)
 }
 
 func main() {
@@ -272,8 +801,18 @@ Where subcommand is one of: %v
 
 func filter(selfName string, args []string) {
 	var outputDir string
+	var srcRoot, goWork string
+	var excludeFiles, excludeFuncs, buildFlags, modules stringList
+	var tests, goMod bool
 	set := flag.NewFlagSet(selfName, flag.ExitOnError)
 	set.StringVar(&outputDir, "dir", "", "The output directory for all filtered code")
+	set.StringVar(&srcRoot, "src", "", "The directory that the output directory mirrors (default: the current directory)")
+	set.Var(&modules, "module", "The root of a local module being filtered, under -src (repeatable; default: -src)")
+	set.StringVar(&goWork, "work", "", "The go.work file in use, under -src, to rewrite for the output directory")
+	set.BoolVar(&tests, "test", false, "Include the packages' _test.go files")
+	set.Var(&buildFlags, "build-flag", "A flag for loading the packages, as for \"go build\" (repeatable)")
+	registerExcludes(set, &excludeFiles, &excludeFuncs)
+	set.BoolVar(&goMod, "go-mod", true, "Add the requirements of the generated code to the output's go.mod and go.sum")
 	set.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), FilterUsage, selfName)
 		set.PrintDefaults()
@@ -289,128 +828,144 @@ func filter(selfName string, args []string) {
 		log.Fatal("No output directory specified")
 	}
 
-	pwd, err := os.Getwd()
-	if err != nil {
-		log.Fatalf("Could not get current directory: %v", err)
-	}
-
-	packageList := set.Args()
-	watchedPackages := map[string]bool{}
-	for _, pkg := range packageList {
-		watchedPackages[pkg] = true
+	pwd := srcRoot
+	if pwd == "" {
+		var err error
+		pwd, err = os.Getwd()
+		if err != nil {
+			log.Fatalf("Could not get current directory: %v", err)
+		}
 	}
 
-	log.Printf("Parsing package %v", packageList)
 	r := gotreload.NewRewriter()
 	r.OutputDir = outputDir
 	r.Pwd = pwd
-	err = r.RewriteGoMod()
+	r.Config.BuildFlags = buildFlags
+	r.Config.Tests = tests
+	r.ExcludeFiles = excludeFiles
+	for _, expr := range excludeFuncs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("Invalid -exclude-func: %v", err)
+		}
+		r.ExcludeFuncs = append(r.ExcludeFuncs, re)
+	}
+	r.Modules = modules
+	r.GoWork = goWork
+	err := r.RewriteGoMod()
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 
-	err = r.Load(packageList...)
+	fc, err := newFilterCache(set.Args(), buildFlags, tests, pwd,
+		strings.Join(excludeFiles, "\x00"), strings.Join(excludeFuncs, "\x00"))
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	err = r.Rewrite(gotreload.ModeRewrite, true)
-	if err != nil {
-		log.Fatalf("%v", err)
+	// Work with the import paths that the arguments, which can be patterns
+	// or directories, match, since packages are cached by their import paths.
+	packageList := fc.roots
+	if len(packageList) == 0 {
+		packageList = set.Args()
 	}
 
-	// Write new source files, and a registration file, for each package.
-	allImports := map[*packages.Package]int{}
-	for _, pkg := range r.Pkgs {
-		// Is this even possible?
-		if len(pkg.Syntax) == 0 {
+	// Restore the packages that haven't changed since they were last
+	// filtered, and filter the rest.
+	keys := map[string]string{}
+	var changed []string
+	var written []*cache.Entry
+	for _, path := range packageList {
+		key, err := fc.key("package", path)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if e, ok := fc.get(key); ok {
+			if err := e.Restore(outputDir); err != nil {
+				log.Fatalf("%v", err)
+			}
+			written = append(written, e)
 			continue
 		}
+		keys[path] = key
+		changed = append(changed, path)
+	}
+	if cached := len(packageList) - len(changed); cached > 0 {
+		log.Printf("Reusing %d cached package(s)", cached)
+	}
+
+	if len(changed) > 0 {
+		log.Printf("Parsing package %v", changed)
+		err = r.Load(changed...)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		err = r.Rewrite(gotreload.ModeRewrite, true)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
 
-		var newDir string
-		// Write new source files for this package, based on the rewritten
-		// syntax tree generated by rewritePkg (called indirectly via r.Rewrite,
-		// above).
-		for _, file := range pkg.Syntax {
-			// log.Printf("Writing filtered version of %s", targetFileName)
-			outputFileName := strings.TrimPrefix(pkg.Fset.Position(file.Pos()).Filename, pwd+"/")
-			newDir = filepath.Join(outputDir, filepath.Dir(outputFileName))
-			_, err := os.Stat(newDir)
+		// Write new source files, and a registration file, for each
+		// package. An external test package is cached with the package it
+		// tests.
+		entries := map[string]*cache.Entry{}
+		for _, pkg := range r.Pkgs {
+			out, err := r.WritePkg(pkg)
 			if err != nil {
-				err := os.MkdirAll(newDir, 0755)
-				if err != nil {
-					log.Fatalf("Error creating %s: %v", newDir, err)
-				}
+				log.Fatalf("%v", err)
 			}
-			_, b, err := gotreload.FormatNode(pkg.Fset, file)
-			if err != nil {
-				log.Fatalf("Error formatting filtered version of %s: %v", outputFileName, err)
+			path := pkg.PkgPath
+			if strings.HasSuffix(pkg.Name, "_test") {
+				// Its ID is "p_test [p.test]".
+				path = strings.TrimSuffix(strings.TrimPrefix(pkg.ID, pkg.PkgPath+" ["), ".test]")
 			}
-			outputFilePath := filepath.Join(newDir, filepath.Base(outputFileName))
-			err = os.WriteFile(outputFilePath, b, 0644)
-			if err != nil {
-				log.Fatalf("Error writing filtered version of %s to %s: %v", outputFileName, outputFilePath, err)
+			e := entries[path]
+			if e == nil {
+				e = &cache.Entry{Files: map[string][]byte{}}
+				entries[path] = e
+			}
+			for name, byts := range out.Files {
+				e.Files[name] = byts
 			}
-			// log.Printf("Wrote %s", outputFilePath)
+			e.Removed = append(e.Removed, out.Removed...)
 		}
-
-		outputFilePath := filepath.Join(newDir, "grl_register.go")
-		err := os.WriteFile(outputFilePath, r.Info[pkg].Registrations, 0644)
-		if err != nil {
-			log.Fatalf("Error writing %s: %v", outputFilePath, err)
+		for path, e := range entries {
+			if key, ok := keys[path]; ok {
+				fc.put(key, e)
+			}
+			written = append(written, e)
 		}
-		// log.Printf("Wrote %s", outputFilePath)
-
-		allImportedPackages(allImports, pkg)
 	}
 
-	pkg0 := r.Pkgs[0]
-	path := filepath.Join(outputDir,
-		filepath.Dir(
-			strings.TrimPrefix(
-				pkg0.Fset.Position(pkg0.Syntax[0].Pos()).Filename,
-				pwd+"/")))
-	for pkg, state := range allImports {
-		if state != 2 {
-			continue
-		}
-		// Skip packages we're watching, since we generate grl_register for
-		// them.
-		if watchedPackages[pkg.PkgPath] {
-			continue
-		}
-
-		fname := filepath.Join(path, "grl_"+strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(pkg.PkgPath)+".go")
-		registrationSource, err := extract.GenContent(fname,
-			pkg0.Name, pkg.PkgPath, pkg.Types,
-			nil, nil, extract.NewImportTracker("", ""))
-		if err != nil {
-			log.Fatalf("Failed generating symbol registration for %q: %v", pkg.PkgPath, err)
-		}
-		if registrationSource == nil {
-			log.Printf("SKIPPING Registrations for %s / %s -> %s", pkg.Name, pkg.PkgPath, fname)
-			continue
-		}
-		// log.Printf("Registrations for %s / %s -> %s", pkg.Name, pkg.PkgPath, fname)
-		// log.Println(string(registrationSource))
-		os.WriteFile(fname, registrationSource, 0644)
+	// Register the symbols of the packages the watched packages import, so
+	// that reloaded code can use them.
+	regs, err := fc.writeDepRegistrations(fc.depRegistrations(r, packageList), outputDir, buildFlags)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-}
+	written = append(written, regs...)
 
-// Find all (direct and indirect) packages imported by pkg
-func allImportedPackages(m map[*packages.Package]int, pkg *packages.Package) {
-	if m[pkg] > 0 {
+	if !goMod {
 		return
 	}
-	// log.Printf("Getting imported packages for %s / %s", pkg.Name, pkg.PkgPath)
-	for _, iPkg := range pkg.Imports {
-		if util.InternalPkg(iPkg.PkgPath) || util.ProbablyStdLib(iPkg.PkgPath) {
-			if m[iPkg] == 0 {
-				// log.Printf("Skipping %s", iPkg.PkgPath)
-				m[iPkg] = 1
-			}
-		} else {
-			allImportedPackages(m, iPkg)
-			m[iPkg] = 2
+	// The copy of the main module (the one in the current directory), and
+	// of the go.work file, if any.
+	moduleRoot, err := mainModuleRoot()
+	if err != nil {
+		log.Fatalf("Unable to find module root: %v", err)
+	}
+	rel, err := filepath.Rel(pwd, moduleRoot)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	workGoWork := ""
+	if goWork != "" {
+		relWork, err := filepath.Rel(pwd, goWork)
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
+		workGoWork = filepath.Join(outputDir, relWork)
+	}
+	if err := updateGoMod(filepath.Join(outputDir, rel), workGoWork, fc, written); err != nil {
+		log.Fatalf("Failed updating go.mod: %v", err)
 	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// reloaderModule is the module whose packages the filtered code imports, and
+// reloaderPkg is the one that pulls in the rest.
+const (
+	reloaderModule = "github.com/got-reload/got-reload"
+	reloaderPkg    = reloaderModule + "/pkg/reloader/start"
+)
+
+// mainModuleRoot returns the root directory of the module in the current
+// directory. (In a workspace, "go list -m" lists all of its modules.)
+func mainModuleRoot() (string, error) {
+	out, err := exec.Command("go", "env", "GOMOD").Output()
+	if err != nil {
+		return "", err
+	}
+	gomod := strings.TrimSpace(string(out))
+	if gomod == "" || gomod == os.DevNull {
+		return "", fmt.Errorf("Not in a module")
+	}
+	return filepath.Dir(gomod), nil
+}
+
+// goWork returns the go.work file in use in dir, if any.
+func goWork(dir string) (string, error) {
+	cmd := exec.Command("go", "env", "GOWORK")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	gowork := strings.TrimSpace(string(out))
+	if gowork == "off" {
+		gowork = ""
+	}
+	return gowork, nil
+}
+
+// localModules returns the root directories of moduleRoot, and of the other
+// local modules (workspace modules, or modules replaced by directories) that
+// contain any of pkgs, sorted.
+func localModules(moduleRoot string, pkgs, buildFlags []string) ([]string, error) {
+	args := append([]string{"list"}, buildFlags...)
+	args = append(args, "-f", "{{with .Module}}{{.Dir}}{{end}}")
+	cmd := exec.Command("go", append(args, pkgs...)...)
+	cmd.Dir = moduleRoot
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed finding the modules of %s: %w", strings.Join(pkgs, ", "), err)
+	}
+	seen := map[string]bool{moduleRoot: true}
+	modules := []string{moduleRoot}
+	for _, dir := range strings.Fields(string(out)) {
+		if !seen[dir] {
+			seen[dir] = true
+			modules = append(modules, dir)
+		}
+	}
+	sort.Strings(modules)
+	return modules, nil
+}
+
+// commonRoot returns the deepest directory that contains all of dirs, which
+// must be absolute.
+func commonRoot(dirs ...string) string {
+	root := dirs[0]
+	for _, dir := range dirs[1:] {
+		for root != dir && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			parent := filepath.Dir(root)
+			if parent == root {
+				break
+			}
+			root = parent
+		}
+	}
+	return root
+}
+
+// vendorMode reports whether the go command loads the dependencies of the
+// module (or workspace) in dir from its vendor directory: it's told to with
+// -mod=vendor in buildFlags or $GOFLAGS, or it's not told otherwise and
+// there's a vendor/modules.txt.
+func vendorMode(dir string, buildFlags []string) (bool, error) {
+	out, err := exec.Command("go", "env", "GOFLAGS").Output()
+	if err != nil {
+		return false, err
+	}
+	mod := modFlag(buildFlags)
+	if mod == "" {
+		mod = modFlag(strings.Fields(string(out)))
+	}
+	if mod != "" {
+		return mod == "vendor", nil
+	}
+	_, err = os.Stat(filepath.Join(dir, "vendor", "modules.txt"))
+	return err == nil, nil
+}
+
+// modFlag returns the value of the last -mod flag in flags, if any.
+func modFlag(flags []string) string {
+	var mod string
+	for i, flag := range flags {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(flag, "-"), "=")
+		if name != "mod" && name != "-mod" {
+			continue
+		}
+		if !hasValue && i+1 < len(flags) {
+			value = flags[i+1]
+		}
+		mod = value
+	}
+	return mod
+}
+
+// unvendoredImports returns the errors "go list" reports for packages that
+// pkgs (with tests set, their tests too) import, in dir, but that aren't in
+// the vendor directory.
+func unvendoredImports(dir string, pkgs, buildFlags []string, tests bool) ([]string, error) {
+	args := append([]string{"list", "-mod=vendor", "-e", "-deps"}, buildFlags...)
+	if tests {
+		args = append(args, "-test")
+	}
+	args = append(args, "-f", "{{with .Error}}{{.}}{{end}}")
+	cmd := exec.Command("go", append(args, pkgs...)...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed listing vendored packages: %w\n%s", err, stderr.String())
+	}
+	var errs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			errs = append(errs, line)
+		}
+	}
+	return errs, nil
+}
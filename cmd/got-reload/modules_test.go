@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModFlag(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"none", []string{"-tags=x", "-race"}, ""},
+		{"with =", []string{"-mod=vendor"}, "vendor"},
+		{"separate value", []string{"-mod", "readonly"}, "readonly"},
+		{"double dash", []string{"--mod=mod"}, "mod"},
+		{"last wins", []string{"-mod=vendor", "-tags=x", "-mod=mod"}, "mod"},
+		{"other flag", []string{"-modfile=x.mod"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, modFlag(test.flags))
+		})
+	}
+}
+
+func TestVendorMode(t *testing.T) {
+	vendored := t.TempDir()
+	writeFile(t, filepath.Join(vendored, "vendor", "modules.txt"), "")
+	unvendored := t.TempDir()
+
+	tests := []struct {
+		name       string
+		dir        string
+		goflags    string
+		buildFlags []string
+		want       bool
+	}{
+		{"vendor directory", vendored, "", nil, true},
+		{"no vendor directory", unvendored, "", nil, false},
+		{"GOFLAGS", unvendored, "-mod=vendor", nil, true},
+		{"GOFLAGS overrides directory", vendored, "-mod=mod", nil, false},
+		{"build flag", unvendored, "", []string{"-mod=vendor"}, true},
+		{"build flag overrides GOFLAGS", vendored, "-mod=vendor", []string{"-mod=readonly"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GOFLAGS", test.goflags)
+			got, err := vendorMode(test.dir, test.buildFlags)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestUnvendoredImports(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"vendor/modules.txt":        "# example.org/x v1.0.0\n## explicit\nexample.org/x\n",
+		"vendor/example.org/x/x.go": "package x\n",
+		"vendored/vendored.go":      "package vendored\n\nimport _ \"example.org/x\"\n",
+		"unvendored/unvendored.go":  "package unvendored\n\nimport _ \"example.org/y\"\n",
+		"testonly/testonly.go":      "package testonly\n",
+		"testonly/testonly_test.go": "package testonly\n\nimport _ \"example.org/y\"\n",
+	})
+	writeFile(t, filepath.Join(dir, "go.mod"), "module example.com/m\n\ngo 1.22\n\nrequire example.org/x v1.0.0\n")
+	t.Setenv("GOFLAGS", "")
+
+	tests := []struct {
+		pkg   string
+		tests bool
+		want  int
+	}{
+		{"./vendored", false, 0},
+		{"./unvendored", false, 1},
+		{"./testonly", false, 0},
+		{"./testonly", true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.pkg, func(t *testing.T) {
+			errs, err := unvendoredImports(dir, []string{test.pkg}, nil, test.tests)
+			require.NoError(t, err)
+			assert.Len(t, errs, test.want, "%q", errs)
+			for _, e := range errs {
+				assert.Contains(t, e, "example.org/y")
+			}
+		})
+	}
+}
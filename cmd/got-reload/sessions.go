@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/got-reload/got-reload/pkg/workdir"
+)
+
+var LsUsage string = `%[1]s [dir ...]
+
+List got-reload's work directories: the temporary ones in $TMPDIR, and the
+given ones (as passed to -dir), with the module each is a copy of, its age,
+and whether the session that uses it is still running.
+`
+
+var CleanUsage string = `%[1]s [flags] [dir ...]
+
+Remove the work directories of sessions that are no longer running: the
+temporary ones in $TMPDIR that were kept (with -keep) or left behind, and the
+given ones (as passed to -dir). Directories that got-reload didn't create are
+never touched.
+
+Flags:
+
+`
+
+func ls(selfName string, args []string) {
+	set := flag.NewFlagSet(selfName, flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), LsUsage, selfName)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		set.Usage()
+		os.Exit(1)
+	}
+	sessions := listSessions(set.Args())
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIR\tMODULE\tAGE\tSTATUS")
+	for _, s := range sessions {
+		status := "stale"
+		if s.Running() {
+			status = fmt.Sprintf("running (pid %d)", s.PID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Dir, s.Module, s.Age().Round(time.Second), status)
+	}
+	w.Flush()
+}
+
+func clean(selfName string, args []string) {
+	var minAge time.Duration
+	var dryRun bool
+	set := flag.NewFlagSet(selfName, flag.ExitOnError)
+	set.DurationVar(&minAge, "age", 0, "Only remove directories at least this old, e.g. \"24h\"")
+	set.BoolVar(&dryRun, "n", false, "Print what would be removed, without removing it")
+	set.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), CleanUsage, selfName)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		set.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, s := range listSessions(set.Args()) {
+		if s.Running() || s.Age() < minAge {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would remove %s (%s, %s old)\n", s.Dir, s.Module, s.Age().Round(time.Second))
+			continue
+		}
+		if err := s.Remove(); err != nil {
+			log.Printf("%v", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Removed %s (%s, %s old)\n", s.Dir, s.Module, s.Age().Round(time.Second))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// listSessions returns the sessions in got-reload's temporary directories
+// and in dirs, warning about those of dirs that aren't work directories.
+func listSessions(dirs []string) []*workdir.Session {
+	for _, dir := range dirs {
+		if _, err := workdir.Read(dir); errors.Is(err, fs.ErrNotExist) {
+			log.Printf("%s isn't a got-reload work directory", dir)
+		}
+	}
+	sessions, err := workdir.List(dirs...)
+	if err != nil {
+		log.Fatalf("Unable to list work directories: %v", err)
+	}
+	return sessions
+}
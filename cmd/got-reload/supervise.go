@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// forwardedSignals are the signals that "run" and "test" pass on to the
+// program, or "go test", while it runs.
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// exitf is exitf for once there's a work dir, which it closes before
+// exiting.
+func (s *session) exitf(code ExitCode, format string, v ...any) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	s.close()
+	os.Exit(int(code))
+}
+
+// handleSignals passes forwardedSignals on to the running command, if any,
+// and otherwise exits as if killed by them, closing the session.
+func (s *session) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	go func() {
+		for sig := range signals {
+			s.childMu.Lock()
+			child, tool := s.child, s.childTool
+			if tool {
+				s.signaled = sig
+			}
+			s.childMu.Unlock()
+			if child == nil {
+				s.exitf(signalExitCode(sig), "Exiting on %v", sig)
+			}
+			if !forwardSignal(sig, tool, inForeground()) {
+				continue
+			}
+			if err := child.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				log.Printf("Unable to pass %v on: %v", sig, err)
+			}
+		}
+	}()
+}
+
+// forwardSignal reports whether to pass sig on to the running command, our
+// tool or not, with foreground set if we're in the terminal's foreground
+// process group. The terminal sends its signals (^C, and SIGHUP on hanging
+// up) to that whole group, the program included, and a second one could cut
+// short its graceful shutdown. Our tools, which have none, always get them.
+func forwardSignal(sig os.Signal, tool, foreground bool) bool {
+	return tool || sig == syscall.SIGTERM || !foreground
+}
+
+// runChild runs cmd, the program or "go test", passing signals on to it.
+func (s *session) runChild(cmd *exec.Cmd) error {
+	return s.runCmd(cmd, false)
+}
+
+// runTool runs cmd, one of our tools, and exits once it does if it's
+// signaled.
+func (s *session) runTool(cmd *exec.Cmd) error {
+	err := s.runCmd(cmd, true)
+	s.childMu.Lock()
+	sig := s.signaled
+	s.childMu.Unlock()
+	if sig != nil {
+		s.exitf(signalExitCode(sig), "Exiting on %v", sig)
+	}
+	return err
+}
+
+func (s *session) runCmd(cmd *exec.Cmd, tool bool) error {
+	s.childMu.Lock()
+	err := cmd.Start()
+	if err == nil {
+		s.child, s.childTool = cmd, tool
+	}
+	s.childMu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = cmd.Wait()
+	s.childMu.Lock()
+	s.child = nil
+	s.childMu.Unlock()
+	return err
+}
+
+// exitChild closes the session and exits with the status of the child that
+// runChild ran, given its error.
+func (s *session) exitChild(name string, err error) {
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		s.exitf(Failed, "Failed running %s: %v", name, err)
+	}
+	code := 0
+	if exitErr != nil {
+		code = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			log.Printf("%s was killed by %v", name, status.Signal())
+			code = int(signalExitCode(status.Signal()))
+		} else {
+			log.Printf("%s exited with status %d", name, code)
+		}
+	}
+	s.close()
+	os.Exit(code)
+}
+
+// signalExitCode returns the status shells report for a process killed by
+// sig.
+func signalExitCode(sig os.Signal) ExitCode {
+	if sig, ok := sig.(syscall.Signal); ok {
+		return ExitCode(128 + int(sig))
+	}
+	return Failed
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// inForeground reports whether we're in the foreground process group of the
+// terminal on stdin. There are no process groups here.
+func inForeground() bool {
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// otherSignal is an os.Signal that isn't a syscall.Signal.
+type otherSignal struct{}
+
+func (otherSignal) String() string { return "other" }
+func (otherSignal) Signal()        {}
+
+func TestSignalExitCode(t *testing.T) {
+	tests := []struct {
+		sig  os.Signal
+		want ExitCode
+	}{
+		{os.Interrupt, 130},
+		{syscall.SIGKILL, 137},
+		{syscall.SIGTERM, 143},
+		{otherSignal{}, Failed},
+	}
+	for _, test := range tests {
+		t.Run(test.sig.String(), func(t *testing.T) {
+			assert.Equal(t, test.want, signalExitCode(test.sig))
+		})
+	}
+}
+
+func TestForwardSignal(t *testing.T) {
+	tests := []struct {
+		name       string
+		sig        os.Signal
+		tool       bool
+		foreground bool
+		want       bool
+	}{
+		{"interrupt in the background", os.Interrupt, false, false, true},
+		{"interrupt in the foreground", os.Interrupt, false, true, false},
+		{"hangup in the foreground", syscall.SIGHUP, false, true, false},
+		{"terminate in the foreground", syscall.SIGTERM, false, true, true},
+		{"interrupt to a tool in the foreground", os.Interrupt, true, true, true},
+		{"hangup to a tool in the background", syscall.SIGHUP, true, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, forwardSignal(test.sig, test.tool, test.foreground))
+		})
+	}
+}
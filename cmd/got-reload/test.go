@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var TestUsage string = `%[1]s [flags] [<package> ...] [-- <go test flags>]
+
+Filter the watched packages, including their _test.go files, and run "go test"
+on the given packages (default: the watched packages) with the reloader
+started, so that edits to the code under test are reloaded while the tests
+run. Everything after "--" is passed to "go test", e.g. "-- -run TestServer
+-v -timeout 1h". Changes that cannot be hot-reloaded are logged.
+
+Flags:
+
+`
+
+func test(selfName string, args []string) {
+	var flags sessionFlags
+
+	args, goTestArgs := splitAt(argListDelimiter, args)
+	set := flag.NewFlagSet(selfName, flag.ExitOnError)
+	flags.register(set)
+	set.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), TestUsage, selfName)
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		set.Usage()
+		os.Exit(1)
+	}
+	cfg, moduleRoot := flags.config(set, "", false)
+	testPkgs := set.Args()
+	if len(testPkgs) == 0 && len(cfg.Packages) == 0 {
+		set.Usage()
+		exitf(FailedUsage, "No packages to test")
+	}
+	if err := cfg.resolvePackages(testPkgs, true); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(testPkgs) == 0 {
+		// Import paths, unlike patterns, mean the same thing in the work
+		// dir.
+		testPkgs = cfg.Packages
+	}
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Could not get current directory: %v", err)
+	}
+	rel, err := filepath.Rel(moduleRoot, pwd)
+	if err != nil {
+		log.Fatalf("Could not find %s relative to %s: %v", pwd, moduleRoot, err)
+	}
+
+	s := newSession(cfg, moduleRoot, true)
+	env, err := s.reloaderEnv()
+	if err != nil {
+		s.exitf(Failed, "%v", err)
+	}
+	for key, val := range env {
+		os.Setenv(key, val)
+	}
+
+	testArgs := []string{"test"}
+	if cfg.Verbose {
+		testArgs = append(testArgs, "-v")
+	}
+	testArgs = append(testArgs, cfg.BuildFlags...)
+	testArgs = append(testArgs, goTestArgs...)
+	testArgs = append(testArgs, testPkgs...)
+
+	// Run from the same place relative to the work dir as we are relative to
+	// the module, so that relative package patterns mean the same thing.
+	cmd := exec.Command("go", testArgs...)
+	cmd.Dir = filepath.Join(s.workModule, rel)
+	cmd.Env = cfg.environ(s.goEnv())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	// Build and vet errors go to stderr.
+	stderr := s.diagWriter(cmd.Dir)
+	cmd.Stderr = stderr
+	err = s.runChild(cmd)
+	stderr.Close()
+	s.exitChild("go test", err)
+}
@@ -0,0 +1,234 @@
+/*
+Package cache stores filtered source files across got-reload runs, so that
+packages that haven't changed needn't be loaded, type-checked and rewritten
+again.
+
+Entries are keyed by strings built with Key from everything that goes into
+the filtered output: the package's contents and its dependencies', the Go
+version, the build flags and the version of got-reload itself.
+*/
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// DirEnv names the environment variable that overrides the cache directory.
+// Set it to "off" to disable the cache.
+const DirEnv = "GOT_RELOAD_CACHE"
+
+const (
+	// Entries that haven't been used for this long are removed.
+	maxAge = 5 * 24 * time.Hour
+	// How often to look for such entries, and how often to update an
+	// entry's last use.
+	trimInterval  = 24 * time.Hour
+	touchInterval = time.Hour
+
+	trimFile = "trim.txt"
+)
+
+// Cache is a directory of cache entries.
+type Cache struct {
+	dir string
+}
+
+// Entry is the output of filtering something: files to write and files to
+// remove, relative to the output directory.
+type Entry struct {
+	Files   map[string][]byte `json:"files"`
+	Removed []string          `json:"removed,omitempty"`
+}
+
+// Dir returns the cache directory: $GOT_RELOAD_CACHE if it's set, and
+// got-reload under the user's cache directory if not. It returns "" if the
+// cache is disabled.
+func Dir() (string, error) {
+	dir := os.Getenv(DirEnv)
+	switch {
+	case dir == "off":
+		return "", nil
+	case dir != "":
+		return dir, nil
+	}
+	userDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("Unable to find a cache directory; set %s: %w", DirEnv, err)
+	}
+	return filepath.Join(userDir, "got-reload"), nil
+}
+
+// Open opens the cache in dir, creating it if needed, and removes old
+// entries from it every so often.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating cache directory: %w", err)
+	}
+	c := &Cache{dir: dir}
+	c.trim()
+	return c, nil
+}
+
+// Key returns a cache key for parts.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		// The length keeps ("ab", "c") and ("a", "bc") apart.
+		fmt.Fprintf(h, "%d:%s\n", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashFiles returns a hash of the names and contents of the given files in
+// dir.
+func HashFiles(dir string, names []string) (string, error) {
+	h := sha256.New()
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\n", name)
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "\n%d\n", n)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ToolVersion identifies the running got-reload, for use in keys. Released
+// and committed builds are identified by their version; anything else, by a
+// hash of the executable.
+func ToolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Path + "@" + info.Main.Version
+		}
+		var revision, modified string
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value
+			}
+		}
+		if revision != "" && modified != "true" {
+			return info.Main.Path + " " + revision
+		}
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		var hash string
+		hash, err = HashFiles(filepath.Dir(exe), []string{filepath.Base(exe)})
+		if err == nil {
+			return "exe " + hash
+		}
+	}
+	// Never match anything.
+	return fmt.Sprintf("unknown %d", time.Now().UnixNano())
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Get returns the entry for key, if there is one.
+func (c *Cache) Get(key string) (*Entry, bool) {
+	path := c.path(key)
+	byts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var e Entry
+	if err := json.Unmarshal(byts, &e); err != nil {
+		return nil, false
+	}
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > touchInterval {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	return &e, true
+}
+
+// Put stores e as the entry for key.
+func (c *Cache) Put(key string, e *Entry) error {
+	byts, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("Error encoding cache entry: %w", err)
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Error creating cache directory: %w", err)
+	}
+	// Write and rename, so that concurrent runs never see part of an entry.
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return fmt.Errorf("Error writing cache entry: %w", err)
+	}
+	_, err = tmp.Write(byts)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Error writing cache entry: %w", err)
+	}
+	return nil
+}
+
+// Restore writes e's files to dir, and removes its removed files from it.
+func (e *Entry) Restore(dir string) error {
+	for name, byts := range e.Files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("Error creating %s: %w", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, byts, 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %w", path, err)
+		}
+	}
+	for _, name := range e.Removed {
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Error removing %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// trim removes entries that haven't been used for maxAge, if it hasn't done
+// so for trimInterval. Failures just leave entries around.
+func (c *Cache) trim() {
+	marker := filepath.Join(c.dir, trimFile)
+	if info, err := os.Stat(marker); err == nil && time.Since(info.ModTime()) < trimInterval {
+		return
+	}
+	os.WriteFile(marker, nil, 0644)
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && time.Since(info.ModTime()) > maxAge {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package cache_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/got-reload/got-reload/pkg/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	c, err := cache.Open(t.TempDir())
+	require.NoError(t, err)
+	assert.NotEqual(t, cache.Key("ab", "c"), cache.Key("a", "bc"), "keys of different parts")
+
+	key := cache.Key("pkg", "example.com/p")
+	_, ok := c.Get(key)
+	assert.False(t, ok, "entry before Put")
+	err = c.Put(key, &cache.Entry{
+		Files:   map[string][]byte{"p/grl_register.go": []byte("package p\n")},
+		Removed: []string{"p/main.go"},
+	})
+	require.NoError(t, err)
+	e, ok := c.Get(key)
+	require.True(t, ok, "entry after Put")
+
+	out := t.TempDir()
+	removed := filepath.Join(out, "p", "main.go")
+	require.NoError(t, os.MkdirAll(filepath.Dir(removed), 0755))
+	require.NoError(t, os.WriteFile(removed, nil, 0644))
+	require.NoError(t, e.Restore(out))
+	byts, err := os.ReadFile(filepath.Join(out, "p", "grl_register.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package p\n", string(byts))
+	assert.NoFileExists(t, removed)
+}
+
+func TestHashFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644))
+	h1, err := cache.HashFiles(dir, []string{"a.go"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.go"), []byte("package a // edited\n"), 0644))
+	h2, err := cache.HashFiles(dir, []string{"a.go"})
+	require.NoError(t, err)
+	assert.NotEqual(t, h1, h2)
+}
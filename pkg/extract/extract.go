@@ -78,6 +78,18 @@ func init() {
 		{{end}}
 		{{- end -}}
 	},
+	{{- range $path, $insts := .Instances}}
+	"{{$path}}": {
+		// instantiations of generic functions and types
+		{{range $inst := $insts -}}
+			{{- if $inst.Type -}}
+				"{{$inst.Name}}": reflect.ValueOf((*{{$inst.Expr}})(nil)),
+			{{else -}}
+				"{{$inst.Name}}": reflect.ValueOf({{$inst.Expr}}),
+			{{end -}}
+		{{end}}
+	},
+	{{- end}}
 	})
 }
 {{- if .Wrap }}
@@ -104,8 +116,8 @@ func init() {
 
 {{- if .NeedsPublicType }}
 // Type aliases
-{{range $unexportedName, $rec := .NeedsPublicType -}}
-type {{$rec.Name}} = {{$rec.Pkg}}.{{$unexportedName}}
+{{range $not_used, $rec := .NeedsPublicType -}}
+type {{$rec.Name}} = {{$rec.Pkg}}.{{$rec.Type}}
 {{end}}
 {{end}}
 `
@@ -126,6 +138,14 @@ type Method struct {
 	Name, Param, Result, Arg, Ret string
 }
 
+// Instance stores information for registering a concrete instantiation of a
+// generic function or type, which interpreted code can't instantiate itself.
+type Instance struct {
+	Name string // the name it's registered as
+	Expr string // "package.name[type-args]"
+	Type bool   // true if it's a type
+}
+
 // Wrap stores information for generating interface wrapper.
 type Wrap struct {
 	Name   string
@@ -139,8 +159,11 @@ type FieldAccessor struct {
 	FieldType string // name of type of field
 }
 
+// PublicType is a non-internal alias, Name, of the type Pkg.Type from an
+// internal package.
 type PublicType struct {
 	Pkg  string
+	Type string
 	Name string
 }
 
@@ -172,6 +195,23 @@ func GenContent(
 	setFuncs map[string]bool,
 	needsPublicType map[string]PublicType,
 	imports *ImportTracker,
+) ([]byte, error) {
+	return GenContentIncluding(destPath, destPkg, importPath, p, nil, setFuncs, needsPublicType, nil, imports)
+}
+
+// GenContentIncluding is like GenContent, but registers only the objects in
+// p's scope for which include returns true. A nil include registers them
+// all. It also registers instances, by the registration keys ("path/name")
+// of their generics' packages.
+func GenContentIncluding(
+	destPath, // for goimports call
+	destPkg, importPath string,
+	p *types.Package,
+	include func(types.Object) bool,
+	setFuncs map[string]bool,
+	needsPublicType map[string]PublicType,
+	instances map[string][]Instance,
+	imports *ImportTracker,
 ) ([]byte, error) {
 	prefix := "_" + importPath + "_"
 	prefix = strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(prefix)
@@ -190,6 +230,9 @@ func GenContent(
 NAME:
 	for _, name := range sc.Names() {
 		o := sc.Lookup(name)
+		if include != nil && !include(o) {
+			continue
+		}
 
 		pkgPrefix := imports.GetAlias(o.Pkg().Name(), o.Pkg().Path())
 		if pkgPrefix != "" {
@@ -198,8 +241,13 @@ NAME:
 
 		if !o.Exported() {
 			if pkgPrefix == "" {
-				// It's in this package: export it
-				name = "GRLx_" + name
+				// It's in this package: export it. The exception is main(), in
+				// a package main relocated by the rewriter, which becomes Main().
+				if _, isFunc := o.(*types.Func); isFunc && name == "main" && o.Pkg().Name() == "main" {
+					name = "Main"
+				} else {
+					name = "GRLx_" + name
+				}
 			} else {
 				// It's not in this package: skip it
 				continue
@@ -338,7 +386,7 @@ NAME:
 		val[name] = Val{name, true}
 	}
 
-	if len(val) == 0 && len(typ) == 0 && len(needsPublicType) == 0 {
+	if len(val) == 0 && len(typ) == 0 && len(needsPublicType) == 0 && len(instances) == 0 {
 		log.Printf("No vals or types or public types, etc: %s, %s", destPkg, importPath)
 		return nil, nil
 	}
@@ -388,6 +436,7 @@ NAME:
 		"Wrap":            wrap,
 		"BuildTags":       buildTags,
 		"NeedsPublicType": needsPublicType,
+		"Instances":       instances,
 	}
 	err = parse.Execute(b, data)
 	if err != nil {
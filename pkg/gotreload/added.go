@@ -0,0 +1,184 @@
+package gotreload
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// Functions and methods added while the program runs have no compiled
+// counterparts. The reloader defines their stub variables itself, and, for
+// functions, registers their names, which forward to the stubs; compiled
+// types can't gain methods, so reloaded code calls new methods' stubs
+// directly (see CallMethodStubs).
+
+// StubbedFunc returns the name of the function or method stubbed by stubVar
+// in pkgPath, as filtered, and whether it's a method.
+func (r *Rewriter) StubbedFunc(pkgPath, stubVar string) (string, bool, error) {
+	_, node := r.FuncNode(pkgPath, stubVar)
+	decl := r.decls[node]
+	if decl == nil {
+		return "", false, fmt.Errorf("No stubVar found for %s:%s", pkgPath, stubVar)
+	}
+	return decl.Name.Name, decl.Recv != nil, nil
+}
+
+// CallMethodStubs rewrites calls, in the stubbed functions of pkgPath, of the
+// methods stubbed by stubVars, which the program wasn't built with, as calls
+// of their stubs, e.g. "t.m(x)" as "GRLfvar_T_m(t, x)". Method expressions,
+// e.g. "T.m", become the stubs themselves. Other uses of those methods, such
+// as method values, or calls through interfaces, are left alone.
+func (r *Rewriter) CallMethodStubs(pkgPath string, stubVars map[string]bool) {
+	pkg := r.findPkg(pkgPath)
+	if pkg == nil {
+		return
+	}
+	methods := map[types.Object]string{}
+	for stubVar := range stubVars {
+		decl := r.decls[r.NewFunc[pkgPath][stubVar]]
+		if decl == nil || decl.Recv == nil {
+			continue
+		}
+		if obj := pkg.TypesInfo.Defs[decl.Name]; obj != nil {
+			methods[obj] = stubVar
+		}
+	}
+	if len(methods) == 0 {
+		return
+	}
+
+	post := func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.CallExpr:
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok {
+				break
+			}
+			selection := pkg.TypesInfo.Selections[sel]
+			if selection == nil || selection.Kind() != types.MethodVal {
+				break
+			}
+			if stubVar, ok := methods[origin(selection.Obj())]; ok {
+				n.Fun = &ast.Ident{NamePos: sel.Sel.Pos(), Name: stubVar}
+				n.Args = append([]ast.Expr{methodRecv(pkg, sel.X, selection)}, n.Args...)
+			}
+		case *ast.SelectorExpr:
+			selection := pkg.TypesInfo.Selections[n]
+			if selection == nil || selection.Kind() != types.MethodExpr {
+				break
+			}
+			stubVar, ok := methods[origin(selection.Obj())]
+			if !ok {
+				break
+			}
+			// The stub's receiver parameter is the method's, so
+			// "(*T).m", for a method of T, doesn't fit.
+			_, isPtr := selection.Recv().(*types.Pointer)
+			if isPtr == recvIsPtr(selection.Obj()) {
+				c.Replace(&ast.Ident{NamePos: n.Sel.Pos(), Name: stubVar})
+			}
+		}
+		return true
+	}
+	for _, funcLit := range r.NewFunc[pkgPath] {
+		if funcLit.Body != nil {
+			astutil.Apply(funcLit.Body, nil, post)
+		}
+	}
+}
+
+// methodRecv returns x, whose method selection selects, as the receiver the
+// method is declared with, e.g. "&x" for a method of *T, or "x.T" for one
+// promoted from an embedded T.
+func methodRecv(pkg *packages.Package, x ast.Expr, selection *types.Selection) ast.Expr {
+	t := selection.Recv()
+	index := selection.Index()
+	for _, i := range index[:len(index)-1] {
+		if ptr, ok := t.(*types.Pointer); ok {
+			t = ptr.Elem()
+		}
+		field := t.Underlying().(*types.Struct).Field(i)
+		name := field.Name()
+		if field.Pkg() == pkg.Types && !field.Exported() {
+			name = exportPrefix + name
+		}
+		x = &ast.SelectorExpr{X: x, Sel: &ast.Ident{NamePos: x.End(), Name: name}}
+		t = field.Type()
+	}
+	_, isPtr := types.Unalias(t).(*types.Pointer)
+	switch wantPtr := recvIsPtr(selection.Obj()); {
+	case wantPtr && !isPtr:
+		return &ast.UnaryExpr{OpPos: x.Pos(), Op: token.AND, X: x}
+	case !wantPtr && isPtr:
+		return &ast.StarExpr{Star: x.Pos(), X: x}
+	}
+	return x
+}
+
+// recvIsPtr reports whether method has a pointer receiver.
+func recvIsPtr(method types.Object) bool {
+	_, ok := method.Type().(*types.Signature).Recv().Type().(*types.Pointer)
+	return ok
+}
+
+// addedFuncReason describes why fn, a function or method that pkg declares
+// and the program wasn't built with, can't be added by reloading, if it
+// can't: it's generic, or it's excluded from reloading, or compiled code,
+// such as a package-level variable's initializer, uses it. desc describes
+// fn, e.g. "function F" or "method T.M".
+func (r *Rewriter) addedFuncReason(pkg *packages.Package, fn *types.Func, desc string) string {
+	sig := fn.Type().(*types.Signature)
+	switch {
+	case sig.TypeParams().Len() > 0:
+		return fmt.Sprintf("new generic %s", desc)
+	case sig.RecvTypeParams().Len() > 0:
+		return fmt.Sprintf("new %s of a generic type", desc)
+	}
+
+	var bodies []*ast.BlockStmt
+	stubbed := false
+	for _, funcLit := range r.NewFunc[pkg.PkgPath] {
+		if decl := r.decls[funcLit]; decl != nil && pkg.TypesInfo.Defs[decl.Name] == fn {
+			stubbed = true
+		}
+		if funcLit.Body != nil {
+			bodies = append(bodies, funcLit.Body)
+		}
+	}
+	if !stubbed {
+		return fmt.Sprintf("new %s is excluded from reloading", desc)
+	}
+
+	var compiled []token.Position
+	for ident, obj := range pkg.TypesInfo.Uses {
+		if origin(obj) != fn || inBodies(bodies, ident.Pos()) {
+			continue
+		}
+		compiled = append(compiled, pkg.Fset.Position(ident.Pos()))
+	}
+	if len(compiled) == 0 {
+		return ""
+	}
+	first := compiled[0]
+	for _, pos := range compiled[1:] {
+		if pos.Filename < first.Filename || (pos.Filename == first.Filename && pos.Offset < first.Offset) {
+			first = pos
+		}
+	}
+	return fmt.Sprintf("new %s is used by compiled code at %s:%d", desc, filepath.Base(first.Filename), first.Line)
+}
+
+// inBodies reports whether pos is in one of bodies.
+func inBodies(bodies []*ast.BlockStmt, pos token.Pos) bool {
+	for _, body := range bodies {
+		if body.Pos() <= pos && pos < body.End() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package gotreload
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/got-reload/got-reload/pkg/extract"
+	"golang.org/x/tools/go/packages"
+)
+
+// Unreloadable compares the package pkgPath as loaded by r with the same
+// package as loaded by newR, and describes each change that cannot be applied
+// by replacing function bodies: new or changed types, new package-level
+// variables and constants, changed constant values, changed function and
+// method signatures, new functions and methods that can't be added (see
+// addedFuncReason), removed declarations, changes to init functions and to
+// package-level variables' initializers, which have already run, changes to
+// excluded functions and methods, which aren't stubbed, and new
+// instantiations of generics from other packages, which aren't registered.
+//
+// The result is sorted, and empty if everything that changed can be
+// reloaded.
+func (r *Rewriter) Unreloadable(newR *Rewriter, pkgPath string) []string {
+	oldPkg := r.findPkg(pkgPath)
+	newPkg := newR.findPkg(pkgPath)
+	if oldPkg == nil || newPkg == nil || oldPkg.Types == nil || newPkg.Types == nil {
+		return nil
+	}
+
+	oldScope := oldPkg.Types.Scope()
+	newScope := newPkg.Types.Scope()
+	oldQual := types.RelativeTo(oldPkg.Types)
+	newQual := types.RelativeTo(newPkg.Types)
+
+	reasons := map[string]bool{}
+	for _, name := range oldScope.Names() {
+		if oldObj := oldScope.Lookup(name); newScope.Lookup(name) == nil {
+			reasons[fmt.Sprintf("removed %s %s", objKind(oldObj), name)] = true
+		}
+	}
+	for _, name := range newScope.Names() {
+		newObj := newScope.Lookup(name)
+		oldObj := oldScope.Lookup(name)
+		if oldObj == nil {
+			if fn, ok := newObj.(*types.Func); ok {
+				if reason := newR.addedFuncReason(newPkg, fn, "function "+name); reason != "" {
+					reasons[reason] = true
+				}
+				continue
+			}
+			reasons[fmt.Sprintf("new %s %s", objKind(newObj), name)] = true
+			continue
+		}
+		if objKind(oldObj) != objKind(newObj) {
+			reasons[fmt.Sprintf("%s changed from %s to %s", name, objKind(oldObj), objKind(newObj))] = true
+			continue
+		}
+
+		switch newObj := newObj.(type) {
+		case *types.Const:
+			oldObj := oldObj.(*types.Const)
+			if types.TypeString(oldObj.Type(), oldQual) != types.TypeString(newObj.Type(), newQual) ||
+				oldObj.Val().Kind() != newObj.Val().Kind() ||
+				!constant.Compare(oldObj.Val(), token.EQL, newObj.Val()) {
+
+				reasons[fmt.Sprintf("value of constant %s changed", name)] = true
+			}
+		case *types.Var:
+			if types.TypeString(oldObj.Type(), oldQual) != types.TypeString(newObj.Type(), newQual) {
+				reasons[fmt.Sprintf("type of variable %s changed", name)] = true
+			}
+		case *types.Func:
+			if types.TypeString(oldObj.Type(), oldQual) != types.TypeString(newObj.Type(), newQual) {
+				reasons[fmt.Sprintf("signature of %s changed", name)] = true
+			}
+		case *types.TypeName:
+			oldObj := oldObj.(*types.TypeName)
+			if types.TypeString(oldObj.Type().Underlying(), oldQual) != types.TypeString(newObj.Type().Underlying(), newQual) {
+				reasons[fmt.Sprintf("definition of type %s changed", name)] = true
+			}
+			changed, added := methodChanges(name, oldObj.Type(), newObj.Type(), oldQual, newQual)
+			for _, reason := range changed {
+				reasons[reason] = true
+			}
+			for _, m := range added {
+				if reason := newR.addedFuncReason(newPkg, m, "method "+name+"."+m.Name()); reason != "" {
+					reasons[reason] = true
+				}
+			}
+		}
+	}
+
+	// Initialization has already run.
+	oldInits, oldVars := initSources(oldPkg)
+	newInits, newVars := initSources(newPkg)
+	if strings.Join(oldInits, "\x00") != strings.Join(newInits, "\x00") {
+		reasons["init functions changed"] = true
+	}
+	for name, src := range newVars {
+		// New variables are reported above.
+		if name != "_" && oldScope.Lookup(name) == nil {
+			continue
+		}
+		if strings.Join(oldVars[name], "\x00") != strings.Join(src, "\x00") {
+			reasons[fmt.Sprintf("initializer of %s changed", varDesc(name))] = true
+		}
+	}
+	for name := range oldVars {
+		if _, ok := newVars[name]; !ok && (name == "_" || newScope.Lookup(name) != nil) {
+			reasons[fmt.Sprintf("initializer of %s removed", varDesc(name))] = true
+		}
+	}
+
+	// The program can only use the instantiations it registered.
+	registered := map[string]bool{}
+	for _, inst := range instances(oldPkg, extract.NewImportTracker(oldPkg.Name, oldPkg.PkgPath)) {
+		registered[inst.Name] = true
+	}
+	for _, inst := range instances(newPkg, extract.NewImportTracker(newPkg.Name, newPkg.PkgPath)) {
+		if !registered[inst.Name] {
+			reasons[fmt.Sprintf("new instantiation %s", inst)] = true
+		}
+	}
+
+	oldExcluded := r.excludedFuncs(oldPkg)
+	for name, src := range newR.excludedFuncs(newPkg) {
+		if oldSrc, ok := oldExcluded[name]; ok && oldSrc != src {
+			reasons[fmt.Sprintf("%s changed, but is excluded from reloading", name)] = true
+		}
+	}
+
+	var list []string
+	for reason := range reasons {
+		list = append(list, reason)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// initSources returns the source of pkg's init functions, in order, and of
+// its package-level variables' initializers, by variable name; those of
+// blank variables are all under "_", in order. The declarations the rewriter
+// generates, which the type checker never saw, are left out.
+func initSources(pkg *packages.Package) ([]string, map[string][]string) {
+	format := func(node ast.Node) string {
+		src, _, err := FormatNode(pkg.Fset, node)
+		if err != nil {
+			return fmt.Sprintf("unformattable: %v", err)
+		}
+		return src
+	}
+	var inits []string
+	vars := map[string][]string{}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if _, ok := pkg.TypesInfo.Defs[decl.Name]; ok && decl.Recv == nil && decl.Name.Name == "init" {
+					inits = append(inits, format(decl))
+				}
+			case *ast.GenDecl:
+				if decl.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range decl.Specs {
+					spec := spec.(*ast.ValueSpec)
+					for i, ident := range spec.Names {
+						obj, ok := pkg.TypesInfo.Defs[ident]
+						if !ok || len(spec.Values) == 0 {
+							continue
+						}
+						name := "_"
+						if obj != nil {
+							name = obj.Name()
+						}
+						var src string
+						if len(spec.Values) == len(spec.Names) {
+							src = format(spec.Values[i])
+						} else {
+							// One multi-valued expression.
+							src = fmt.Sprintf("%d of %s", i, format(spec.Values[0]))
+						}
+						vars[name] = append(vars[name], src)
+					}
+				}
+			}
+		}
+	}
+	return inits, vars
+}
+
+// varDesc describes the package-level variable with the given name.
+func varDesc(name string) string {
+	if name == "_" {
+		return "a blank variable"
+	}
+	return "variable " + name
+}
+
+// methodChanges reports methods whose signatures changed between two versions
+// of the named type typeName, and returns the new methods.
+func methodChanges(typeName string, oldT, newT types.Type, oldQual, newQual types.Qualifier) ([]string, []*types.Func) {
+	oldNamed, ok1 := oldT.(*types.Named)
+	newNamed, ok2 := newT.(*types.Named)
+	if !ok1 || !ok2 {
+		return nil, nil
+	}
+	oldMethods := map[string]*types.Func{}
+	for i := 0; i < oldNamed.NumMethods(); i++ {
+		m := oldNamed.Method(i)
+		oldMethods[m.Name()] = m
+	}
+	var reasons []string
+	var added []*types.Func
+	for i := 0; i < newNamed.NumMethods(); i++ {
+		m := newNamed.Method(i)
+		old, ok := oldMethods[m.Name()]
+		delete(oldMethods, m.Name())
+		if !ok {
+			added = append(added, m)
+			continue
+		}
+		if types.TypeString(old.Type(), oldQual) != types.TypeString(m.Type(), newQual) {
+			reasons = append(reasons, fmt.Sprintf("signature of %s.%s changed", typeName, m.Name()))
+		}
+	}
+	for name := range oldMethods {
+		reasons = append(reasons, fmt.Sprintf("removed method %s.%s", typeName, name))
+	}
+	return reasons, added
+}
+
+func objKind(obj types.Object) string {
+	switch obj.(type) {
+	case *types.Const:
+		return "constant"
+	case *types.Var:
+		return "variable"
+	case *types.Func:
+		return "function"
+	case *types.TypeName:
+		return "type"
+	default:
+		return "identifier"
+	}
+}
+
+func (r *Rewriter) findPkg(pkgPath string) *packages.Package {
+	for _, pkg := range r.Pkgs {
+		if pkg.PkgPath == pkgPath {
+			return pkg
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package gotreload
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
+)
+
+// FuncReport says whether a top-level function or method will be
+// hot-reloadable, and if not, why not.
+type FuncReport struct {
+	Package    string   `json:"package"`
+	Name       string   `json:"name"`
+	Position   string   `json:"position"`
+	Reloadable bool     `json:"reloadable"`
+	Reasons    []string `json:"reasons,omitempty"`
+}
+
+// Check reports on the reloadability of every top-level function and method
+// in r.Pkgs, in source order, including those that r's exclusion rules leave
+// unstubbed. It does not rewrite anything, so call it before Rewrite, if at
+// all.
+func (r *Rewriter) Check() []FuncReport {
+	var reports []FuncReport
+	for _, pkg := range r.Pkgs {
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				funcDecl, ok := decl.(*ast.FuncDecl)
+				if !ok {
+					continue
+				}
+				reasons := unreloadableReasons(pkg, funcDecl)
+				if why := r.excluded(pkg, file, funcDecl); why != "" {
+					reasons = append(reasons, "excluded: "+why)
+				}
+				reports = append(reports, FuncReport{
+					Package:    pkg.PkgPath,
+					Name:       funcName(funcDecl),
+					Position:   pkg.Fset.Position(funcDecl.Pos()).String(),
+					Reloadable: len(reasons) == 0,
+					Reasons:    reasons,
+				})
+			}
+		}
+	}
+	return reports
+}
+
+// unreloadableReasons returns the reasons funcDecl cannot be hot-reloaded, if
+// any.
+func unreloadableReasons(pkg *packages.Package, funcDecl *ast.FuncDecl) []string {
+	var reasons []string
+	if funcDecl.Recv == nil && funcDecl.Name.Name == "init" {
+		reasons = append(reasons, "init function")
+	}
+	if funcDecl.Recv == nil && funcDecl.Name.Name == "main" && pkg.Name == "main" {
+		reasons = append(reasons, "main function (it has already run)")
+	}
+	if funcDecl.Body == nil {
+		reasons = append(reasons, "no body (assembly or linkname)")
+		return reasons
+	}
+	if referencesC(funcDecl.Body) {
+		reasons = append(reasons, "references C symbols")
+	}
+	if neverReturns(funcDecl.Body) {
+		reasons = append(reasons, "never returns (infinite loop or empty select), so a new version would never run")
+	}
+	return reasons
+}
+
+// funcName returns "F" for functions, "T.M" for methods with value
+// receivers, and "(*T).M" for methods with pointer receivers.
+func funcName(funcDecl *ast.FuncDecl) string {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		return funcDecl.Name.Name
+	}
+	recv := funcDecl.Recv.List[0].Type
+	if star, ok := recv.(*ast.StarExpr); ok {
+		return "(*" + recvTypeName(star.X) + ")." + funcDecl.Name.Name
+	}
+	return recvTypeName(recv) + "." + funcDecl.Name.Name
+}
+
+// recvTypeName returns the name of a receiver's base type, without any type
+// parameters.
+func recvTypeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return recvTypeName(t.X)
+	case *ast.ParenExpr:
+		return recvTypeName(t.X)
+	case *ast.IndexExpr:
+		return recvTypeName(t.X)
+	case *ast.IndexListExpr:
+		return recvTypeName(t.X)
+	}
+	return ""
+}
+
+// recvHasTypeParams reports whether expr, a receiver's type, has type
+// parameters.
+func recvHasTypeParams(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return recvHasTypeParams(t.X)
+	case *ast.ParenExpr:
+		return recvHasTypeParams(t.X)
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return true
+	}
+	return false
+}
+
+// referencesC reports whether node refers to any cgo symbols, either as
+// written (C.foo) or as rewritten by cgo (_Cfunc_foo and friends).
+func referencesC(node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := n.X.(*ast.Ident); ok && x.Name == "C" {
+				found = true
+			}
+		case *ast.Ident:
+			if strings.HasPrefix(n.Name, "_C") &&
+				(strings.HasPrefix(n.Name, "_Cfunc_") ||
+					strings.HasPrefix(n.Name, "_Ctype_") ||
+					strings.HasPrefix(n.Name, "_Cvar_") ||
+					strings.HasPrefix(n.Name, "_Cmacro_")) {
+
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// neverReturns reports whether body contains, at its top level, a "for" loop
+// with no condition that nothing inside can leave, or an empty select.
+func neverReturns(body *ast.BlockStmt) bool {
+	for _, stmt := range body.List {
+		label := ""
+		if labeled, ok := stmt.(*ast.LabeledStmt); ok {
+			label = labeled.Label.Name
+			stmt = labeled.Stmt
+		}
+		switch stmt := stmt.(type) {
+		case *ast.ForStmt:
+			if stmt.Cond == nil && !canLeave(stmt.Body, label) {
+				return true
+			}
+		case *ast.SelectStmt:
+			if len(stmt.Body.List) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canLeave reports whether anything in loopBody can leave the loop: a
+// return, a goto, a break of the loop itself, or a panic.
+func canLeave(loopBody *ast.BlockStmt, label string) bool {
+	leaves := false
+	// depth counts the breakable statements (for, range, switch, select)
+	// between the loop and the current node, since an unlabeled break inside
+	// one of them doesn't leave our loop.
+	depth := 0
+	pre := func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			leaves = true
+		case *ast.BranchStmt:
+			switch n.Tok {
+			case token.GOTO:
+				leaves = true
+			case token.BREAK:
+				if n.Label != nil {
+					leaves = leaves || n.Label.Name == label
+				} else if depth == 0 {
+					leaves = true
+				}
+			}
+		case *ast.CallExpr:
+			if ident, ok := n.Fun.(*ast.Ident); ok && ident.Name == "panic" {
+				leaves = true
+			}
+		case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			depth++
+		}
+		return !leaves
+	}
+	post := func(c *astutil.Cursor) bool {
+		switch c.Node().(type) {
+		case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			depth--
+		}
+		return true
+	}
+	astutil.Apply(loopBody, pre, post)
+	return leaves
+}
@@ -0,0 +1,223 @@
+package gotreload
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Renames maps the names that rewriting introduces in a package to what they
+// stand for in the original source: exported names ("GRLx_f") to the
+// original names ("f"), stub variables ("GRLfvar_T_M") and the functions
+// that populate them ("GRLfinit_T_M") to their functions ("T.M", as
+// returned by origFuncName), and the aliases of internal types
+// ("GRLt_internal_pkg_T_h…") to the types ("pkg.T"). See Manifest.Renames.
+type Renames map[string]string
+
+// IntroducedNote is appended to the diagnostics that DiagTranslator finds are
+// about code that rewriting introduced, rather than about the original
+// source.
+const IntroducedNote = " (introduced by got-reload's rewriting)"
+
+var (
+	// Paths to Go files, as the go command and the compiler print them.
+	diagPathRE = regexp.MustCompile(`[^\s:"'()\[\]]+\.go\b`)
+	// The names rewriting introduces.
+	diagIdentRE = regexp.MustCompile(`\b(` + exportPrefix + `|` + stubPrefix + `|` + stubInitPrefix + `|` + utypePrefix + `|` +
+		syntheticArgPrefix + `|` + syntheticReceiver + `)\w*`)
+	// Import paths of relocated packages main.
+	diagRelocatedRE = regexp.MustCompile(`\S*/` + MainPackageName + `\b\S*`)
+	// A diagnostic's position.
+	diagPosRE = regexp.MustCompile(`\.go:\d+`)
+)
+
+// A DiagTranslator translates the go command's diagnostics about a filtered
+// tree, such as build and vet errors, into terms of the original source, so
+// that they read as they would for it: names get their original spelling
+// back, paths to copies point at the originals, and relocated packages main
+// get their import paths back. Diagnostics about code that rewriting
+// introduced get IntroducedNote.
+//
+// Positions in filtered files mostly need no translating, thanks to the
+// //line directives WritePkg emits.
+type DiagTranslator struct {
+	// The filtered tree, and the directory it's a copy of.
+	OutputDir, SrcRoot string
+	// The directory the go command runs in, which relative paths in its
+	// output are relative to.
+	Dir string
+	// The directory to make translated paths relative to, as the go
+	// command does.
+	Cwd string
+
+	// Every package's Renames, loaded from the Manifests under OutputDir
+	// when first needed.
+	renames Renames
+}
+
+// NewDiagTranslator returns a DiagTranslator for the output of a go command
+// run in dir, under outputDir, a filtered copy of srcRoot.
+func NewDiagTranslator(outputDir, srcRoot, dir string) *DiagTranslator {
+	cwd, _ := os.Getwd()
+	return &DiagTranslator{OutputDir: outputDir, SrcRoot: srcRoot, Dir: dir, Cwd: cwd}
+}
+
+// Translate translates line, one line of the go command's output.
+func (t *DiagTranslator) Translate(line string) string {
+	introduced := false
+	line = diagRelocatedRE.ReplaceAllStringFunc(line, func(path string) string {
+		if diagPathRE.MatchString(path) {
+			return path
+		}
+		return strings.Replace(path, "/"+MainPackageName, "", 1)
+	})
+	line = diagPathRE.ReplaceAllStringFunc(line, func(path string) string {
+		path, generated := t.sourcePath(path)
+		introduced = introduced || generated
+		return path
+	})
+	line = diagIdentRE.ReplaceAllStringFunc(line, func(name string) string {
+		name, synthetic := t.origName(name)
+		introduced = introduced || synthetic
+		return name
+	})
+	if introduced && diagPosRE.MatchString(line) {
+		line += IntroducedNote
+	}
+	return line
+}
+
+// sourcePath returns the path to the original of path, a file in the go
+// command's output, relative to t.Cwd if it's under it, and whether it's a
+// file that filtering generated. Generated files have no originals, so they
+// keep their paths under t.OutputDir.
+func (t *DiagTranslator) sourcePath(path string) (string, bool) {
+	abs := path
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(t.Dir, abs)
+	}
+	rel, err := filepath.Rel(t.OutputDir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// Most likely an original already, from a //line directive.
+		return t.shortPath(abs), false
+	}
+	if strings.HasPrefix(filepath.Base(rel), "grl_") {
+		return t.shortPath(abs), true
+	}
+	if dir := filepath.Dir(rel); filepath.Base(dir) == MainPackageName {
+		rel = filepath.Join(filepath.Dir(dir), filepath.Base(rel))
+	}
+	return t.shortPath(filepath.Join(t.SrcRoot, rel)), false
+}
+
+// shortPath returns path relative to t.Cwd, if it's under it, as the go
+// command prints paths.
+func (t *DiagTranslator) shortPath(path string) string {
+	rel, err := filepath.Rel(t.Cwd, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	if filepath.Dir(rel) == "." {
+		return "." + string(filepath.Separator) + rel
+	}
+	return rel
+}
+
+// origName returns what name, a name rewriting introduced, stands for in
+// the original source, and whether it's a name with no counterpart there.
+func (t *DiagTranslator) origName(name string) (string, bool) {
+	if t.renames == nil {
+		t.renames = t.loadRenames()
+	}
+	orig, ok := t.renames[name]
+	switch {
+	case strings.HasPrefix(name, exportPrefix):
+		if !ok {
+			orig = strings.TrimPrefix(name, exportPrefix)
+		}
+		return orig, false
+	case strings.HasPrefix(name, stubPrefix):
+		if !ok {
+			orig = strings.TrimPrefix(name, stubPrefix)
+		}
+		return "<stub for " + orig + ">", true
+	case strings.HasPrefix(name, stubInitPrefix):
+		if !ok {
+			orig = strings.TrimPrefix(name, stubInitPrefix)
+		}
+		return "<stub initializer for " + orig + ">", true
+	case strings.HasPrefix(name, utypePrefix):
+		if !ok {
+			orig = strings.TrimPrefix(name, utypePrefix+"internal_")
+		}
+		return orig, true
+	default:
+		// A synthetic argument or receiver, which was unnamed or "_".
+		return "_", true
+	}
+}
+
+// loadRenames returns the Renames of every package's Manifest under
+// t.OutputDir, merged. They agree on the names they share.
+func (t *DiagTranslator) loadRenames() Renames {
+	renames := Renames{}
+	filepath.WalkDir(t.OutputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasPrefix(d.Name(), "grl_manifest") || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		byts, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var m Manifest
+		if err := json.Unmarshal(byts, &m); err != nil {
+			return nil
+		}
+		for name, orig := range m.Renames() {
+			renames[name] = orig
+		}
+		return nil
+	})
+	return renames
+}
+
+// Writer returns a writer that translates what's written to it a line at a
+// time, and writes it to w. Close it to write any unterminated last line.
+func (t *DiagTranslator) Writer(w io.Writer) io.WriteCloser {
+	return &diagWriter{t: t, w: w}
+}
+
+type diagWriter struct {
+	t   *DiagTranslator
+	w   io.Writer
+	buf []byte
+}
+
+func (d *diagWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	for {
+		i := bytes.IndexByte(d.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := d.t.Translate(string(d.buf[:i]))
+		d.buf = d.buf[i+1:]
+		if _, err := io.WriteString(d.w, line+"\n"); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (d *diagWriter) Close() error {
+	if len(d.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(d.w, d.t.Translate(string(d.buf)))
+	d.buf = nil
+	return err
+}
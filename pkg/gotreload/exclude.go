@@ -0,0 +1,148 @@
+package gotreload
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// SkipDirective leaves functions compiled as-is, instead of stubbing them.
+// Put it in a function's doc comment to skip that function, or on a line of
+// its own before a file's package clause to skip every function in the file.
+const SkipDirective = "//got-reload:skip"
+
+// excluded returns why funcDecl, in file, should be left compiled as-is
+// instead of being stubbed, or "" if it shouldn't: file matches one of r's
+// ExcludeFiles patterns or is generated, funcDecl's name matches one of r's
+// ExcludeFuncs expressions, or either has a SkipDirective.
+func (r *Rewriter) excluded(pkg *packages.Package, file *ast.File, funcDecl *ast.FuncDecl) string {
+	base := filepath.Base(pkg.Fset.Position(file.Pos()).Filename)
+	for _, pattern := range r.ExcludeFiles {
+		if match, _ := filepath.Match(pattern, base); match {
+			return fmt.Sprintf("file matches %q", pattern)
+		}
+	}
+	r.directivesMu.Lock()
+	d := r.directives[pkg.Fset.PositionFor(file.Pos(), false).Filename]
+	r.directivesMu.Unlock()
+	switch {
+	case d == nil:
+	case d.generated:
+		return "generated file"
+	case d.skip:
+		return "file has " + SkipDirective
+	case d.skipLines[pkg.Fset.PositionFor(funcDecl.Pos(), false).Line]:
+		return SkipDirective
+	}
+	name := origFuncName(pkg, funcDecl)
+	for _, re := range r.ExcludeFuncs {
+		if re.MatchString(name) {
+			return fmt.Sprintf("name matches %q", re)
+		}
+	}
+	return ""
+}
+
+// fileDirectives are the exclusion directives in a file.
+type fileDirectives struct {
+	// Whether the file is generated, or has a file-wide SkipDirective.
+	generated, skip bool
+	// The lines of the "func" keywords of the functions with a
+	// SkipDirective.
+	skipLines map[int]bool
+}
+
+// noteDirectives records the exclusion directives in filename, whose
+// contents are src, if it has any.
+func (r *Rewriter) noteDirectives(filename string, src []byte) {
+	if !bytes.Contains(src, []byte(SkipDirective)) && !bytes.Contains(src, []byte("DO NOT EDIT")) {
+		return
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		// The real parse reports it.
+		return
+	}
+	d := &fileDirectives{generated: ast.IsGenerated(file), skipLines: map[int]bool{}}
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		d.skip = d.skip || hasDirective(group, SkipDirective)
+	}
+	for _, decl := range file.Decls {
+		if funcDecl, ok := decl.(*ast.FuncDecl); ok && hasDirective(funcDecl.Doc, SkipDirective) {
+			d.skipLines[fset.PositionFor(funcDecl.Pos(), false).Line] = true
+		}
+	}
+	r.directivesMu.Lock()
+	r.directives[filename] = d
+	r.directivesMu.Unlock()
+}
+
+// hasDirective reports whether group has a line that's just directive.
+func hasDirective(group *ast.CommentGroup, directive string) bool {
+	if group == nil {
+		return false
+	}
+	for _, comment := range group.List {
+		if strings.TrimSpace(comment.Text) == directive {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedFuncs returns the source of each of pkg's excluded functions and
+// methods, by name, as returned by origFuncName.
+func (r *Rewriter) excludedFuncs(pkg *packages.Package) map[string]string {
+	funcs := map[string]string{}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			funcDecl, ok := decl.(*ast.FuncDecl)
+			if !ok || r.excluded(pkg, file, funcDecl) == "" {
+				continue
+			}
+			src, _, err := FormatNode(pkg.Fset, funcDecl)
+			if err != nil {
+				src = fmt.Sprintf("unformattable: %v", err)
+			}
+			funcs[origFuncName(pkg, funcDecl)] = src
+		}
+	}
+	return funcs
+}
+
+// origFuncName is like funcName, but uses the names funcDecl had before they
+// were exported.
+func origFuncName(pkg *packages.Package, funcDecl *ast.FuncDecl) string {
+	obj, ok := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func)
+	if !ok {
+		return funcName(funcDecl)
+	}
+	recv := obj.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return obj.Name()
+	}
+	recvType := recv.Type()
+	ptr, isPtr := recvType.(*types.Pointer)
+	if isPtr {
+		recvType = ptr.Elem()
+	}
+	named, ok := recvType.(*types.Named)
+	if !ok {
+		return funcName(funcDecl)
+	}
+	if isPtr {
+		return "(*" + named.Obj().Name() + ")." + obj.Name()
+	}
+	return named.Obj().Name() + "." + obj.Name()
+}
@@ -0,0 +1,278 @@
+package gotreload
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const (
+	// The package that holds the reloaded instantiations of generic
+	// functions, and the name filtered files import it as.
+	genericPkgPath    = "github.com/got-reload/got-reload/pkg/reloader/generic"
+	genericImportName = importPrefix + "generic"
+
+	// Stand for the type parameters of a generic function, and the
+	// instantiated receiver type of a method of a generic type, in
+	// GenericFuncDef.
+	typeArgPlaceholder  = utypePrefix + "arg"
+	recvTypePlaceholder = utypePrefix + "recv"
+
+	// Used to name "_" type parameters of receivers.
+	syntheticTypeParamPrefix = utypePrefix + "param"
+)
+
+var (
+	typeArgPlaceholderRE  = regexp.MustCompile(`\b` + typeArgPlaceholder + `(\d+)\b`)
+	recvTypePlaceholderRE = regexp.MustCompile(`\b` + recvTypePlaceholder + `\b`)
+)
+
+// A genericFunc is a stubbed generic function, or method of a generic type.
+type genericFunc struct {
+	// The function's type parameters, or its receiver's.
+	typeParams []*types.TypeName
+	// For a method, where the type of the stub's receiver parameter keeps
+	// the receiver's base type, e.g. "T[K, V]" in "*T[K, V]".
+	recvType *ast.Expr
+}
+
+// isGeneric reports whether funcDecl is a generic function, or a method of a
+// generic type.
+func isGeneric(funcDecl *ast.FuncDecl) bool {
+	return funcDecl.Type.TypeParams != nil ||
+		(funcDecl.Recv != nil && recvHasTypeParams(funcDecl.Recv.List[0].Type))
+}
+
+// typeParamIdents returns the names of funcDecl's type parameters, or its
+// receiver's.
+func typeParamIdents(funcDecl *ast.FuncDecl) []*ast.Ident {
+	var idents []*ast.Ident
+	if funcDecl.Type.TypeParams != nil {
+		for _, field := range funcDecl.Type.TypeParams.List {
+			idents = append(idents, field.Names...)
+		}
+		return idents
+	}
+	var indices []ast.Expr
+	switch t := (*recvTypeSlot(&funcDecl.Recv.List[0].Type)).(type) {
+	case *ast.IndexExpr:
+		indices = []ast.Expr{t.Index}
+	case *ast.IndexListExpr:
+		indices = t.Indices
+	}
+	for _, index := range indices {
+		if ident, ok := index.(*ast.Ident); ok {
+			idents = append(idents, ident)
+		}
+	}
+	return idents
+}
+
+// recvTypeSlot returns where *expr, a receiver's type, keeps its base type.
+func recvTypeSlot(expr *ast.Expr) *ast.Expr {
+	switch t := (*expr).(type) {
+	case *ast.StarExpr:
+		return recvTypeSlot(&t.X)
+	case *ast.ParenExpr:
+		return recvTypeSlot(&t.X)
+	}
+	return expr
+}
+
+// rewriteGenericFunc is rewriteFunc for generic functions and methods of
+// generic types, given the function literal's type, with no type parameters,
+// and the arguments to pass it. Generic functions can't be stubbed with
+// variables, so their stub variables are generic.Funcs instead, which hold
+// the reloaded instantiations, and the function keeps its body, for those
+// that haven't been reloaded.
+func rewriteGenericFunc(name string, node *ast.FuncDecl, funcType *ast.FuncType, args []ast.Expr, ellipsisPos token.Pos) (string, []ast.Decl, *ast.FuncLit) {
+	declPos := node.Pos()
+
+	// func(<type-params>), which is the same type exactly when the type
+	// arguments are.
+	keyType := &ast.FuncType{Func: declPos, Params: &ast.FieldList{}}
+	for i, typeParam := range typeParamIdents(node) {
+		if typeParam.Name == "_" {
+			// A receiver's, which it doesn't use, but the key needs. In
+			// place, so that it keeps its position.
+			typeParam.Name = fmt.Sprintf("%s%d", syntheticTypeParamPrefix, i)
+		}
+		keyType.Params.List = append(keyType.Params.List,
+			&ast.Field{Type: &ast.Ident{NamePos: declPos, Name: typeParam.Name}})
+	}
+
+	// generic.Get[<func-type>, func(<type-params>)](&<name>)
+	get := &ast.CallExpr{
+		Fun: &ast.IndexListExpr{
+			X: &ast.SelectorExpr{
+				X:   &ast.Ident{NamePos: declPos, Name: genericImportName},
+				Sel: &ast.Ident{NamePos: declPos, Name: "Get"},
+			},
+			Lbrack:  declPos,
+			Indices: []ast.Expr{funcType, keyType},
+			Rbrack:  declPos,
+		},
+		Lparen: declPos,
+		Args: []ast.Expr{&ast.UnaryExpr{
+			OpPos: declPos,
+			Op:    token.AND,
+			X:     &ast.Ident{NamePos: declPos, Name: name},
+		}},
+		Rparen: declPos,
+	}
+
+	// Shadowing the stub variable keeps the name out of the way of the
+	// function's own.
+	stubCall := &ast.CallExpr{
+		Fun:      &ast.Ident{NamePos: declPos, Name: name},
+		Args:     args,
+		Ellipsis: ellipsisPos,
+	}
+	var callStmts []ast.Stmt
+	if node.Type.Results == nil {
+		callStmts = []ast.Stmt{&ast.ExprStmt{X: stubCall}, &ast.ReturnStmt{Return: declPos}}
+	} else {
+		callStmts = []ast.Stmt{&ast.ReturnStmt{Return: declPos, Results: []ast.Expr{stubCall}}}
+	}
+
+	// if <name> := <get>; <name> != nil { return <name>(<args>) }
+	ifStmt := &ast.IfStmt{
+		If: declPos,
+		Init: &ast.AssignStmt{
+			Lhs:    []ast.Expr{&ast.Ident{NamePos: declPos, Name: name}},
+			TokPos: declPos,
+			Tok:    token.DEFINE,
+			Rhs:    []ast.Expr{get},
+		},
+		Cond: &ast.BinaryExpr{
+			X:     &ast.Ident{NamePos: declPos, Name: name},
+			OpPos: declPos,
+			Op:    token.NEQ,
+			Y:     &ast.Ident{NamePos: declPos, Name: "nil"},
+		},
+		Body: &ast.BlockStmt{Lbrace: declPos, List: callStmts, Rbrace: declPos},
+	}
+
+	funcLit := &ast.FuncLit{
+		Type: funcType,
+		Body: node.Body,
+	}
+
+	// var <name> generic.Func
+	newVar := &ast.GenDecl{
+		TokPos: declPos,
+		Tok:    token.VAR,
+		Specs: []ast.Spec{
+			&ast.ValueSpec{
+				Names: []*ast.Ident{{NamePos: declPos, Name: name}},
+				Type: &ast.SelectorExpr{
+					X:   &ast.Ident{NamePos: declPos, Name: genericImportName},
+					Sel: &ast.Ident{NamePos: declPos, Name: "Func"},
+				},
+			}}}
+
+	// func <real-name>[<type-params>]<signature> { <if-reloaded-call-it>; <real-body> }
+	node.Body = &ast.BlockStmt{
+		Lbrace: node.Body.Lbrace,
+		List:   append([]ast.Stmt{ifStmt}, node.Body.List...),
+		Rbrace: node.Body.Rbrace,
+	}
+	return name, []ast.Decl{newVar}, funcLit
+}
+
+// newGenericFunc returns funcDecl's genericFunc, given funcLit, its stub's
+// new value.
+func newGenericFunc(pkg *packages.Package, funcDecl *ast.FuncDecl, funcLit *ast.FuncLit) *genericFunc {
+	g := &genericFunc{}
+	for _, ident := range typeParamIdents(funcDecl) {
+		if obj, ok := pkg.TypesInfo.Defs[ident].(*types.TypeName); ok {
+			g.typeParams = append(g.typeParams, obj)
+		}
+	}
+	if funcDecl.Recv != nil {
+		// The receiver is the stub's first parameter.
+		g.recvType = recvTypeSlot(&funcLit.Type.Params.List[0].Type)
+	}
+	return g
+}
+
+// IsGeneric reports whether stubVar, in pkgPath, is the stub of a generic
+// function or a method of a generic type, which GenericFuncDef returns the
+// definition of.
+func (r *Rewriter) IsGeneric(pkgPath, stubVar string) bool {
+	_, node := r.FuncNode(pkgPath, stubVar)
+	return node != nil && r.generics[node] != nil
+}
+
+// GenericFuncDef is FuncDef for the stub of a generic function or a method
+// of a generic type, with every use of the type parameters replaced by a
+// placeholder, for InstantiateFuncDef to replace with type arguments. It
+// also reports whether the function is a method, whose receiver's base type
+// is replaced by a placeholder too, since the interpreter can't instantiate
+// compiled generic types.
+func (r *Rewriter) GenericFuncDef(pkgPath, stubVar string) (string, bool, error) {
+	pkg, node := r.FuncNode(pkgPath, stubVar)
+	if pkg == nil || node == nil || r.generics[node] == nil {
+		return "", false, fmt.Errorf("No generic stubVar found for %s:%s", pkgPath, stubVar)
+	}
+	g := r.generics[node]
+	index := map[types.Object]int{}
+	for i, typeParam := range g.typeParams {
+		index[typeParam] = i
+	}
+
+	// Replace the nodes in place, and put them back once they're formatted.
+	if g.recvType != nil {
+		recvType := *g.recvType
+		*g.recvType = &ast.Ident{NamePos: recvType.Pos(), Name: recvTypePlaceholder}
+		defer func() { *g.recvType = recvType }()
+	}
+	renamed := map[*ast.Ident]string{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			if i, ok := index[pkg.TypesInfo.ObjectOf(ident)]; ok {
+				renamed[ident] = ident.Name
+				ident.Name = fmt.Sprintf("%s%d", typeArgPlaceholder, i)
+			}
+		}
+		return true
+	})
+	defer func() {
+		for ident, name := range renamed {
+			ident.Name = name
+		}
+	}()
+
+	s, _, err := FormatNode(pkg.Fset, node)
+	return s, g.recvType != nil, err
+}
+
+// InstantiateFuncDef returns def, as returned by GenericFuncDef, with
+// typeArgs, which are Go type expressions, in place of its type parameters,
+// and, for a method, recvType in place of its receiver's base type.
+func InstantiateFuncDef(def string, typeArgs []string, recvType string) string {
+	if recvType != "" {
+		def = recvTypePlaceholderRE.ReplaceAllLiteralString(def, recvType)
+	}
+	return typeArgPlaceholderRE.ReplaceAllStringFunc(def, func(placeholder string) string {
+		var i int
+		fmt.Sscanf(typeArgPlaceholderRE.FindStringSubmatch(placeholder)[1], "%d", &i)
+		if i >= len(typeArgs) {
+			return placeholder
+		}
+		typeArg := typeArgs[i]
+		// Types that would bind differently in conversions, e.g. *T(x),
+		// need parentheses.
+		for _, prefix := range []string{"*", "func", "chan", "<-"} {
+			if strings.HasPrefix(typeArg, prefix) {
+				return "(" + typeArg + ")"
+			}
+		}
+		return typeArg
+	})
+}
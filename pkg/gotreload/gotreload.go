@@ -11,7 +11,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/got-reload/got-reload/pkg/extract"
 	"github.com/got-reload/got-reload/pkg/util"
@@ -28,9 +30,24 @@ const (
 	// Used to generate argument names.
 	syntheticArgPrefix = "GRLarg_"
 	syntheticReceiver  = "GRLrecvr"
-	// Used for stub function variable names.
-	stubPrefix  = "GRLfvar_"
-	utypePrefix = "GRLt_"
+	// Used for stub function variable names, and the names of the functions
+	// that populate them.
+	stubPrefix     = "GRLfvar_"
+	stubInitPrefix = "GRLfinit_"
+	utypePrefix    = "GRLt_"
+	// Used for the names packages are imported as.
+	importPrefix = "GRLi_"
+	// Used for the names that instantiations of generic functions and types
+	// from other packages are registered as.
+	instancePrefix = "GRLg_"
+
+	// MainPackageName is the name of the package that the code from a watched
+	// package "main" is moved to, so that it can be imported. It lives in a
+	// subdirectory of the same name under the original main package. The
+	// main function becomes MainFuncName, and the original package is left
+	// with a main that just calls it.
+	MainPackageName = "grl_main"
+	MainFuncName    = "Main"
 )
 
 type (
@@ -47,16 +64,48 @@ type (
 		// different, but package import paths, which are just strings, will be
 		// the same.
 		NewFunc map[string]map[string]*ast.FuncLit
+		// The generic functions, and methods of generic types, in NewFunc.
+		generics map[*ast.FuncLit]*genericFunc
+		// The declarations of the functions and methods in NewFunc.
+		decls map[*ast.FuncLit]*ast.FuncDecl
 
 		// Per-package supplemental information.  Used only in initial rewrite.
 		Info map[*packages.Package]*Info
 
-		// unexported name => pkg name & exported name
+		// Functions and methods to leave unstubbed: those in files whose base
+		// names match one of the ExcludeFiles glob patterns, those whose
+		// names ("F", "T.M", or "(*T).M") match one of the ExcludeFuncs
+		// regular expressions, those in generated files, and those with a
+		// SkipDirective. Their names are still exported.
+		ExcludeFiles []string
+		ExcludeFuncs []*regexp.Regexp
+
+		// The root directories of the local modules being filtered, which
+		// are copied to the same places relative to Pwd under OutputDir. If
+		// it's empty, Pwd is the only one. GoWork is the go.work file in use,
+		// if any; it must be under Pwd too. RewriteGoMod rewrites the go.mod
+		// of each module, and GoWork, for their new places.
+		Modules []string
+		GoWork  string
+
+		// Aliases of the types from internal packages that the package uses
+		// => the types' package names, names and aliases
 		needsPublicType map[string]extract.PublicType
+
+		// File name => the exclusion directives in it. Files are parsed
+		// without comments, so they're found as the files are parsed, which
+		// happens concurrently.
+		directivesMu sync.Mutex
+		directives   map[string]*fileDirectives
 	}
 
 	Info struct {
 		Registrations []byte
+		// Registrations for the symbols declared in _test.go files, when
+		// Config.Tests is set.
+		TestRegistrations []byte
+		// How rewriting renamed the package's identifiers.
+		Manifest *Manifest
 	}
 )
 
@@ -72,29 +121,68 @@ func NewRewriter() *Rewriter {
 				packages.NeedDeps |
 				packages.NeedTypes |
 				packages.NeedSyntax |
-				packages.NeedTypesInfo,
-			ParseFile: func(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
-				return parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
-			},
+				packages.NeedTypesInfo |
+				packages.NeedEmbedFiles |
+				packages.NeedModule,
 		},
-		NewFunc: map[string]map[string]*ast.FuncLit{},
-		Info:    map[*packages.Package]*Info{},
+		NewFunc:    map[string]map[string]*ast.FuncLit{},
+		generics:   map[*ast.FuncLit]*genericFunc{},
+		decls:      map[*ast.FuncLit]*ast.FuncDecl{},
+		Info:       map[*packages.Package]*Info{},
+		directives: map[string]*fileDirectives{},
+	}
+	r.Config.ParseFile = func(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+		r.noteDirectives(filename, src)
+		return parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
 	}
 
 	return &r
 }
 
+// Load loads and type-checks the packages matching paths. If r.Config.Tests
+// is set, it keeps only the variant of each package that includes its
+// _test.go files, plus any external test packages.
 func (r *Rewriter) Load(paths ...string) error {
 	pkgs, err := packages.Load(&r.Config, paths...)
 	if err != nil {
 		return err
 	}
 	packages.PrintErrors(pkgs)
+	if r.Config.Tests {
+		pkgs = testVariants(pkgs)
+	}
 	r.Pkgs = pkgs
 
 	return nil
 }
 
+// testVariants returns pkgs without the generated test mains (IDs like
+// "p.test"), and without the plain variants of packages that also have a
+// test variant (IDs like "p [p.test]").
+func testVariants(pkgs []*packages.Package) []*packages.Package {
+	hasTestVariant := map[string]bool{}
+	for _, pkg := range pkgs {
+		if pkg.ID != pkg.PkgPath && strings.HasSuffix(pkg.ID, ".test]") {
+			hasTestVariant[pkg.PkgPath] = true
+		}
+	}
+	var result []*packages.Package
+	for _, pkg := range pkgs {
+		if strings.HasSuffix(pkg.ID, ".test") ||
+			(pkg.ID == pkg.PkgPath && hasTestVariant[pkg.PkgPath]) {
+
+			continue
+		}
+		result = append(result, pkg)
+	}
+	return result
+}
+
+// IsTestFile reports whether filename is a _test.go file.
+func IsTestFile(filename string) bool {
+	return strings.HasSuffix(filename, "_test.go")
+}
+
 type RewriteMode int
 
 const (
@@ -131,16 +219,20 @@ func (r *Rewriter) Rewrite(mode RewriteMode, genContent bool) error {
 // filtering, and optionally generates and writes a "registration" file for said
 // package.
 func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) error {
-	if pkg.Name == "main" {
-		return fmt.Errorf("Cannot rewrite package \"main\"")
-	}
 	if pkg.Name == "" {
 		return fmt.Errorf("Missing package name: %s %s", pkg.ID, pkg.PkgPath)
 	}
 	// log.Printf("Pkg: %#v", pkg)
+	if err := checkReservedNames(pkg); err != nil {
+		return err
+	}
 
 	r.needsPublicType = map[string]extract.PublicType{}
 	funcs := map[*ast.FuncDecl]string{}
+	// Stubbed functions => their stub variables, and the non-internal
+	// aliases of internal types => the types.
+	stubs := map[*ast.FuncDecl]string{}
+	internalTypes := map[string]*types.TypeName{}
 	stubVars := map[string]bool{}
 	imports := extract.NewImportTracker(pkg.Name, pkg.PkgPath)
 
@@ -149,6 +241,20 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 		new  string
 	}
 	exported := map[types.Object]exportRec{}
+
+	// Move package main to MainPackageName, and export main() as Main().
+	if pkg.Name == "main" {
+		if pkg.Types.Scope().Lookup(MainFuncName) != nil {
+			return fmt.Errorf("Cannot relocate package main (%s): it already declares %s", pkg.PkgPath, MainFuncName)
+		}
+		for _, file := range pkg.Syntax {
+			file.Name.Name = MainPackageName
+		}
+		if obj, ok := pkg.Types.Scope().Lookup("main").(*types.Func); ok {
+			exported[obj] = exportRec{orig: "main", new: MainFuncName}
+		}
+	}
+
 	// Find everything in this package that's at package scope and not exported,
 	// and export it, in-place, by adding a GRLx_ prefix.
 	for ident, obj := range pkg.TypesInfo.Defs {
@@ -165,8 +271,14 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 
 			continue
 		}
-		// Skip generic functions and methods.
-		if s, ok := obj.Type().(*types.Signature); ok && (s.TypeParams().Len() > 0 || s.RecvTypeParams().Len() > 0) {
+		// Skip generic functions, which can't be registered. (Methods of
+		// generic types are exported like any others.)
+		if s, ok := obj.Type().(*types.Signature); ok && s.TypeParams().Len() > 0 {
+			continue
+		}
+		if rec, ok := exported[obj]; ok {
+			// main(), in package main
+			ident.Name = rec.new
 			continue
 		}
 		exported[obj] = exportRec{
@@ -179,7 +291,7 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 	for ident, obj := range pkg.TypesInfo.Uses {
 		// Find everything that references any of the above exported objects, and
 		// reset their names.
-		if rec, ok := exported[obj]; ok {
+		if rec, ok := exported[origin(obj)]; ok {
 			ident.Name = rec.new
 		}
 
@@ -187,9 +299,6 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 		switch obj := obj.(type) {
 		case *types.TypeName:
 			if objPkg := obj.Pkg(); objPkg != nil && util.InternalPkg(objPkg.Path()) {
-				// FIXME: Does not take into account types with the same name in
-				// different internal packages.
-
 				// Note that ident.Name will not be exported (at least, not by us;
 				// that is, will not have a GRLx_ prefix), since it's in a different
 				// package.
@@ -216,12 +325,18 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 							// maybe it shouldn't.
 							pkgName = imports.GetAlias(pkgName, impPath)
 
-							public := utypePrefix + "internal_" + ident.Name
+							public := internalTypeAlias(obj)
+							if other, ok := internalTypes[public]; ok && other != obj {
+								return fmt.Errorf("Internal error: %s and %s would both be aliased as %s",
+									other.Pkg().Path()+"."+other.Name(), objPkg.Path()+"."+obj.Name(), public)
+							}
 							// log.Printf("Rewrite: %s.%s => %s", pkgName, ident.Name, public)
-							r.needsPublicType[ident.Name] = extract.PublicType{
+							r.needsPublicType[public] = extract.PublicType{
 								Pkg:  pkgName,
+								Type: ident.Name,
 								Name: public,
 							}
+							internalTypes[public] = obj
 							break
 						}
 					}
@@ -256,32 +371,56 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 		}
 	}
 
-	r.stubTopLevelFuncs(pkg, funcs, ModeRewrite)
+	if err := r.stubTopLevelFuncs(pkg, funcs, stubs, ModeRewrite); err != nil {
+		return err
+	}
 
 	// Generate symbol registrations
 	// log.Printf("Looking for stubVars for pkg %s", pkg.PkgPath)
-	for stubVar := range r.NewFunc[pkg.PkgPath] {
+	testStubVars := map[string]bool{}
+	for stubVar, funcLit := range r.NewFunc[pkg.PkgPath] {
 		// log.Printf("stubVar: %s", stubVar)
-		stubVars[stubVar] = true
+		if IsTestFile(pkg.Fset.Position(funcLit.Pos()).Filename) {
+			testStubVars[stubVar] = true
+		} else {
+			stubVars[stubVar] = true
+		}
 	}
 
 	if createRegistration {
-		// Create "registrations" for this package.
+		// Create "registrations" for this package. Symbols declared in
+		// _test.go files are registered separately, in a _test.go file of
+		// their own, so that the package still builds without its tests.
 
 		// Get newDir from the first file in the package
-		outputFileName := strings.TrimPrefix(pkg.Fset.Position(pkg.Syntax[0].Pos()).Filename, r.Pwd+"/")
-		newDir := filepath.Join(r.OutputDir, filepath.Dir(outputFileName))
-
-		registrationSource, err := extract.GenContent(newDir+"/grl_unknown.go",
-			pkg.Name, pkg.PkgPath, pkg.Types,
-			stubVars, r.needsPublicType, imports)
+		newDir := filepath.Dir(r.OutputPath(pkg, pkg.Fset.Position(pkg.Syntax[0].Pos()).Filename))
+		inTestFile := func(obj types.Object) bool {
+			return IsTestFile(pkg.Fset.Position(obj.Pos()).Filename)
+		}
+		notInTestFile := func(obj types.Object) bool { return !inTestFile(obj) }
+
+		// Instantiations made in _test.go files are registered with the
+		// symbols declared there.
+		insts := instances(pkg, imports)
+		registrationSource, err := extract.GenContentIncluding(newDir+"/grl_unknown.go",
+			RelocatedName(pkg), RelocatedPath(pkg), pkg.Types, notInTestFile,
+			stubVars, r.needsPublicType, registeredInstances(pkg, insts, func(filename string) bool { return !IsTestFile(filename) }),
+			imports)
 		if err != nil {
 			return fmt.Errorf("Failed generating symbol registration for %q at %s: %w", pkg.Name, pkg.PkgPath, err)
 		}
+		testRegistrationSource, err := extract.GenContentIncluding(newDir+"/grl_unknown_test.go",
+			RelocatedName(pkg), RelocatedPath(pkg), pkg.Types, inTestFile,
+			testStubVars, nil, registeredInstances(pkg, insts, IsTestFile), imports)
+		if err != nil {
+			return fmt.Errorf("Failed generating test symbol registration for %q at %s: %w", pkg.Name, pkg.PkgPath, err)
+		}
 
-		if registrationSource != nil {
-			// log.Printf("generated grl_register.go: %s", string(registrationSource))
-			r.Info[pkg] = &Info{Registrations: registrationSource}
+		// log.Printf("generated grl_register.go: %s", string(registrationSource))
+		r.Info[pkg] = &Info{
+			Registrations:     registrationSource,
+			TestRegistrations: testRegistrationSource,
+			Manifest:          newManifest(pkg, stubs, internalTypes),
 		}
 	}
 
@@ -299,27 +438,46 @@ func (r *Rewriter) rewritePkg(pkg *packages.Package, createRegistration bool) er
 // internal package names (which can't be referenced by a stand-alone "main"
 // package) to use their external aliases.
 func (r *Rewriter) reloadPkg(pkg *packages.Package) error {
-	if pkg.Name == "main" {
-		return fmt.Errorf("Cannot rewrite package \"main\"")
-	}
 	if pkg.Name == "" {
 		return fmt.Errorf("Missing package name: %s %s", pkg.ID, pkg.PkgPath)
 	}
 	// log.Printf("Pkg: %#v", pkg)
 
+	// Types from different internal packages can share a name.
+	publicTypes := map[string][]extract.PublicType{}
+	for _, publicType := range r.needsPublicType {
+		publicTypes[publicType.Type] = append(publicTypes[publicType.Type], publicType)
+	}
+
+	// Refer to the instantiations of generics from other packages by the
+	// names they're registered as, which need no type arguments.
+	insts := instances(pkg, extract.NewImportTracker(pkg.Name, pkg.PkgPath))
+	for ident, inst := range insts {
+		ident.Name = inst.Name
+	}
+
 	for _, file := range pkg.Syntax {
 		replace := map[ast.Node]ast.Node{}
 		pre := func(c *astutil.Cursor) bool {
 			// log.Printf("reload: I see: Obj: %#v", c.Node())
 			switch n := c.Node().(type) {
+			case *ast.IndexExpr:
+				if _, ok := insts[instanceIdent(n.X)]; ok {
+					replace[n] = n.X
+				}
+			case *ast.IndexListExpr:
+				if _, ok := insts[instanceIdent(n.X)]; ok {
+					replace[n] = n.X
+				}
 			case *ast.Ident:
-				if publicType, ok := r.needsPublicType[n.Name]; ok {
+				for _, publicType := range publicTypes[n.Name] {
 					// log.Printf("found an ident resembling one that needs a public type: %[1]v/%#[1]v; parent: %[2]v/%#[2]v",
 					// 	n, c.Parent())
 					switch p := c.Parent().(type) {
 					case *ast.ValueSpec:
 						// log.Printf("Setting public type: %s to %s.%s", n.Name, pkg.Name, publicType)
 						c.Replace(&ast.Ident{Name: publicType.Name})
+						return true
 					case *ast.SelectorExpr:
 						// If the selector's X matches the pubic type's package, then
 						// replace the whole selector expression (x.y) with just the
@@ -351,6 +509,18 @@ func (r *Rewriter) reloadPkg(pkg *packages.Package) error {
 	return nil
 }
 
+// origin returns the generic object that obj, a field or method of an
+// instantiated generic type, was instantiated from, or obj itself.
+func origin(obj types.Object) types.Object {
+	switch obj := obj.(type) {
+	case *types.Var:
+		return obj.Origin()
+	case *types.Func:
+		return obj.Origin()
+	}
+	return obj
+}
+
 // tagForTranslation finds the function/method declaration obj is in, and tags
 // it for translation.
 func tagForTranslation(pkg *packages.Package, funcs map[*ast.FuncDecl]string, obj *types.Func) {
@@ -391,32 +561,55 @@ func tagForTranslation(pkg *packages.Package, funcs map[*ast.FuncDecl]string, ob
 
 // stubTopLevelFuncs finds all the top-level functions and methods and stubs
 // them out. It also saves a pointer to the syntax tree of the function
-// literal, for later use.
-func (r *Rewriter) stubTopLevelFuncs(pkg *packages.Package, funcs map[*ast.FuncDecl]string, _ RewriteMode) {
+// literal, for later use, and records each function's stub variable in
+// stubs.
+func (r *Rewriter) stubTopLevelFuncs(pkg *packages.Package, funcs map[*ast.FuncDecl]string, stubs map[*ast.FuncDecl]string, _ RewriteMode) error {
+	// stubName never gives two functions the same name, but check, since a
+	// collision would otherwise only show up when compiling.
+	stubbed := map[string]*ast.FuncDecl{}
+	var err error
 	for _, file := range pkg.Syntax {
 		pre := func(c *astutil.Cursor) bool {
 			switch n := c.Node().(type) {
 			case *ast.FuncDecl:
 				if name, ok := funcs[n]; ok {
-					// Skip all init() functions.  (We don't need to skip
-					// main.main() because rewriting "main" is an error higher up.)
+					// Skip all init() functions. (main.main() is stubbed, as
+					// Main, like everything else in a relocated package main.)
 					if name == "init" {
 						return false
 					}
+					if r.excluded(pkg, file, n) != "" {
+						return false
+					}
 
 					// log.Printf("Translating %s\n", name)
 
-					stubName, newVar, newInit, funcLit := rewriteFunc(name, n)
-					if newVar != nil {
-						c.InsertAfter(newInit)
-						c.InsertAfter(newVar)
+					stub := stubName(pkg, n)
+					if other, ok := stubbed[stub]; ok {
+						err = fmt.Errorf("Internal error: %s and %s would both be stubbed as %s",
+							origFuncName(pkg, other), origFuncName(pkg, n), stub)
+						return false
+					}
+					stubbed[stub] = n
+
+					stub, newDecls, funcLit := rewriteFunc(stub, n)
+					if newDecls != nil {
+						for i := len(newDecls) - 1; i >= 0; i-- {
+							c.InsertAfter(newDecls[i])
+						}
 
 						// Track stubVar => new function
 						if r.NewFunc[pkg.PkgPath] == nil {
 							r.NewFunc[pkg.PkgPath] = map[string]*ast.FuncLit{}
 						}
 						// log.Printf("Storing %s: %s", pkg.PkgPath, stubPrefix+name)
-						r.NewFunc[pkg.PkgPath][stubName] = funcLit
+						r.NewFunc[pkg.PkgPath][stub] = funcLit
+						r.decls[funcLit] = n
+						stubs[n] = stub
+						if isGeneric(n) {
+							r.generics[funcLit] = newGenericFunc(pkg, n, funcLit)
+							astutil.AddNamedImport(pkg.Fset, file, genericImportName, genericPkgPath)
+						}
 					}
 				}
 			}
@@ -425,7 +618,63 @@ func (r *Rewriter) stubTopLevelFuncs(pkg *packages.Package, funcs map[*ast.FuncD
 
 		// Result ignored because we do not replace the whole file.
 		_ = astutil.Apply(file, pre, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RelocatedPath returns the import path of pkg after filtering. That's
+// pkg.PkgPath, except for package main, which is moved to MainPackageName.
+func RelocatedPath(pkg *packages.Package) string {
+	if pkg.Name == "main" {
+		return pkg.PkgPath + "/" + MainPackageName
+	}
+	return pkg.PkgPath
+}
+
+// RelocatedName returns the package name of pkg after filtering. See
+// RelocatedPath.
+func RelocatedName(pkg *packages.Package) string {
+	if pkg.Name == "main" {
+		return MainPackageName
 	}
+	return pkg.Name
+}
+
+// OutputPath returns the path under r.OutputDir to write the filtered version
+// of filename, a source file in pkg, to.
+func (r *Rewriter) OutputPath(pkg *packages.Package, filename string) string {
+	return filepath.Join(r.OutputPkgDir(pkg.Name, filepath.Dir(filename)), filepath.Base(filename))
+}
+
+// OutputPkgDir returns the directory under r.OutputDir that the filtered
+// version of a package named name, in the directory dir, goes in.
+func (r *Rewriter) OutputPkgDir(name, dir string) string {
+	rel := strings.TrimPrefix(dir, r.Pwd+"/")
+	if rel == r.Pwd {
+		rel = "."
+	}
+	if name == "main" {
+		rel = filepath.Join(rel, MainPackageName)
+	}
+	return filepath.Join(r.OutputDir, rel)
+}
+
+// MainStub returns the source of the package main that replaces a relocated
+// one. It just calls MainFuncName in the relocated package.
+func MainStub(pkg *packages.Package) []byte {
+	return []byte(fmt.Sprintf(`// Code generated by got-reload. DO NOT EDIT.
+
+package main
+
+import %s %q
+
+func main() {
+	%[1]s.%[3]s()
+}
+`, MainPackageName, RelocatedPath(pkg), MainFuncName))
 }
 
 // Print prints the rewritten files to a tree rooted in the given path.
@@ -453,17 +702,16 @@ func (r *Rewriter) Print(root string) error {
 	return nil
 }
 
-// Updates node in place, and returns newVar, newInit, and the funcLit to be
-// added to the AST after node.
+// Updates node in place, and returns the stub variable's name, the
+// declarations to be added to the AST after node (the stub variable, the
+// function that populates it, and an init function), and the funcLit that
+// holds node's old body. name is the stub variable's name, as returned by
+// stubName. Generic functions are left to rewriteGenericFunc.
 //
 // We're doing AST generation so things get a little Lisp-y.
-func rewriteFunc(name string, node *ast.FuncDecl) (string, *ast.GenDecl, *ast.FuncDecl, *ast.FuncLit) {
-	// Don't rewrite generic functions, i.e., functions with type parameters
-	if node.Type.TypeParams != nil {
-		return "", nil, nil, nil
-	}
-
+func rewriteFunc(name string, node *ast.FuncDecl) (string, []ast.Decl, *ast.FuncLit) {
 	newVarType := copyFuncType(node.Type)
+	newVarType.TypeParams = nil
 
 	var newArgs []ast.Expr
 
@@ -475,10 +723,15 @@ func rewriteFunc(name string, node *ast.FuncDecl) (string, *ast.GenDecl, *ast.Fu
 		recvrVarOffset++
 
 		var receiverName string
-		if len(node.Recv.List[0].Names) == 0 || node.Recv.List[0].Names[0].Name == "_" {
+		if recvNames := node.Recv.List[0].Names; len(recvNames) == 0 || recvNames[0].Name == "_" {
 			// If the function has no receiver name, or it's "_", we have to generate one.
 			receiverName = syntheticReceiver
-			node.Recv.List[0].Names = []*ast.Ident{{Name: receiverName}}
+			if len(recvNames) == 0 {
+				node.Recv.List[0].Names = []*ast.Ident{{Name: receiverName}}
+			} else {
+				// In place, so that it keeps its position.
+				recvNames[0].Name = receiverName
+			}
 		} else {
 			receiverName = node.Recv.List[0].Names[0].Name
 		}
@@ -493,14 +746,6 @@ func rewriteFunc(name string, node *ast.FuncDecl) (string, *ast.GenDecl, *ast.Fu
 				Type:  node.Recv.List[0].Type,
 			}},
 			newVarType.Params.List...)
-
-		// Prepend the receiver type to the stub name.
-		switch t := node.Recv.List[0].Type.(type) {
-		case *ast.Ident:
-			name = t.Name + "_" + name
-		case *ast.StarExpr:
-			name = t.X.(*ast.Ident).Name + "_" + name
-		}
 	}
 
 	// See if we need to add '...' to the end of the stub call.
@@ -540,30 +785,59 @@ func rewriteFunc(name string, node *ast.FuncDecl) (string, *ast.GenDecl, *ast.Fu
 	}
 	// log.Printf("rewriteFunc: %s: newArgs: %d, %v", name, len(newArgs), newArgs)
 
-	name = stubPrefix + name
-	// Define the new body of the function/method to just call the stub.
+	if isGeneric(node) {
+		return rewriteGenericFunc(name, node, newVarType, newArgs, ellipsisPos)
+	}
+
+	// The generated code is all positioned at the original declaration, so
+	// that the //line directives WritePkg emits attribute it there. (The old
+	// body keeps its own positions.)
+	declPos := node.Pos()
+
+	initName := stubInitPrefix + strings.TrimPrefix(name, stubPrefix)
+
+	// if <name> == nil { <init-name>() }
+	ensureStub := func() ast.Stmt {
+		return &ast.IfStmt{
+			If: declPos,
+			Cond: &ast.BinaryExpr{
+				X:     &ast.Ident{NamePos: declPos, Name: name},
+				OpPos: declPos,
+				Op:    token.EQL,
+				Y:     &ast.Ident{NamePos: declPos, Name: "nil"},
+			},
+			Body: &ast.BlockStmt{
+				Lbrace: declPos,
+				List: []ast.Stmt{
+					&ast.ExprStmt{X: &ast.CallExpr{
+						Fun:    &ast.Ident{NamePos: declPos, Name: initName},
+						Lparen: declPos,
+						Rparen: declPos,
+					}}},
+				Rbrace: declPos}}
+	}
+
+	// Define the new body of the function/method to just call the stub,
+	// populating it first if need be.
 	stubCall := &ast.CallExpr{
-		Fun:      &ast.Ident{Name: name},
+		Fun:      &ast.Ident{NamePos: declPos, Name: name},
 		Args:     newArgs,
 		Ellipsis: ellipsisPos,
 	}
-	var body *ast.BlockStmt
+	var callStmt ast.Stmt
 	if node.Type.Results == nil {
 		// If the function has no return type, then just call the stub.
-		body = &ast.BlockStmt{
-			List: []ast.Stmt{
-				&ast.ExprStmt{
-					X: stubCall,
-				}}}
+		callStmt = &ast.ExprStmt{X: stubCall}
 	} else {
 		// Add a "return" statement to the stub call.
-		body = &ast.BlockStmt{
-			List: []ast.Stmt{
-				&ast.ReturnStmt{
-					Results: []ast.Expr{
-						stubCall,
-					}}}}
+		callStmt = &ast.ReturnStmt{
+			Return:  declPos,
+			Results: []ast.Expr{stubCall}}
 	}
+	body := &ast.BlockStmt{
+		Lbrace: declPos,
+		List:   []ast.Stmt{ensureStub(), callStmt},
+		Rbrace: declPos}
 
 	funcLit := &ast.FuncLit{
 		Type: newVarType,
@@ -574,26 +848,47 @@ func rewriteFunc(name string, node *ast.FuncDecl) (string, *ast.GenDecl, *ast.Fu
 	//
 	// var <name> <func-type>
 	newVar := &ast.GenDecl{
-		Tok: token.VAR,
+		TokPos: declPos,
+		Tok:    token.VAR,
 		Specs: []ast.Spec{
 			&ast.ValueSpec{
 				Names: []*ast.Ident{{Name: name}},
 				Type:  newVarType,
 			}}}
 
-	// Assign the old body from the function/method to the stub var in an init
-	// function.
+	// Assign the old body from the function/method to the stub var in a
+	// function of its own, rather than in an init function: package-level
+	// variables are initialized before any init function runs, and their
+	// initializers may call the function, directly or not. The function's
+	// body calls it when the stub is still nil, so the stub is populated
+	// before its first use, and Go orders the package's initialization by
+	// the same dependencies it would have without rewriting.
 	//
-	// func init() { <name> = <function-literal> }
-	newInit := &ast.FuncDecl{
-		Name: &ast.Ident{Name: "init"},
-		Type: &ast.FuncType{Params: &ast.FieldList{}},
+	// func <init-name>() { <name> = <function-literal> }
+	newStubInit := &ast.FuncDecl{
+		Name: &ast.Ident{NamePos: declPos, Name: initName},
+		Type: &ast.FuncType{Func: declPos, Params: &ast.FieldList{}},
 		Body: &ast.BlockStmt{
+			Lbrace: declPos,
 			List: []ast.Stmt{
 				&ast.AssignStmt{
-					Lhs: []ast.Expr{&ast.Ident{Name: name}},
+					Lhs: []ast.Expr{&ast.Ident{NamePos: declPos, Name: name}},
 					Tok: token.ASSIGN,
-					Rhs: []ast.Expr{funcLit}}}}}
+					Rhs: []ast.Expr{funcLit}}},
+			Rbrace: funcLit.End()}}
+
+	// Populate the stub in an init function too, if nothing needed it
+	// sooner, so that it's never written after initialization (except by
+	// reloads), when goroutines may be calling the function.
+	//
+	// func init() { if <name> == nil { <init-name>() } }
+	newInit := &ast.FuncDecl{
+		Name: &ast.Ident{Name: "init"},
+		Type: &ast.FuncType{Func: declPos, Params: &ast.FieldList{}},
+		Body: &ast.BlockStmt{
+			Lbrace: declPos,
+			List:   []ast.Stmt{ensureStub()},
+			Rbrace: declPos}}
 
 	// Replace the node's body with the new body in-place.
 	//
@@ -601,9 +896,9 @@ func rewriteFunc(name string, node *ast.FuncDecl) (string, *ast.GenDecl, *ast.Fu
 	//
 	// =>
 	//
-	// func <real-name><signature> { <call-stub-var> }
+	// func <real-name><signature> { <populate-stub>; <call-stub-var> }
 	node.Body = body
-	return name, newVar, newInit, funcLit
+	return name, []ast.Decl{newVar, newStubInit, newInit}, funcLit
 }
 
 func copyFuncType(t *ast.FuncType) *ast.FuncType {
@@ -691,23 +986,60 @@ func FormatNode(fset *token.FileSet, node ast.Node) (string, []byte, error) {
 	return b.String(), b.Bytes(), nil
 }
 
-// RewriteGoMod replaces relative paths in "replace" directives with absolute
-// paths.
+// RewriteGoMod writes the go.mod of each of r.Modules, and r.GoWork, to
+// r.OutputDir, replacing relative paths in "replace" and "use" directives with
+// absolute paths, unless they're paths to the copy of one of r.Modules.
 func (r *Rewriter) RewriteGoMod() error {
-	gomod := filepath.Join(r.Pwd, "go.mod")
-	if _, err := os.Stat(gomod); err != nil {
-		// No go.mod found
+	modules := r.Modules
+	if len(modules) == 0 {
+		modules = []string{r.Pwd}
+	}
+	for _, module := range modules {
+		gomod := filepath.Join(module, "go.mod")
+		if _, err := os.Stat(gomod); err != nil {
+			// No go.mod found
+			continue
+		}
+
+		// Read the file
+		byts, err := os.ReadFile(gomod)
+		if err != nil {
+			return err
+		}
+
+		byts, err = r.rewriteGoMod(gomod, byts)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(r.outputFile(gomod), byts, 0644); err != nil {
+			return err
+		}
+	}
+	if r.GoWork == "" {
 		return nil
 	}
 
-	// Read the file
-	byts, err := os.ReadFile(gomod)
+	byts, err := os.ReadFile(r.GoWork)
 	if err != nil {
 		return err
 	}
+	byts, err = r.rewriteGoWork(r.GoWork, byts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.outputFile(r.GoWork), byts, 0644); err != nil {
+		return err
+	}
+	// Keep the workspace's checksums with it.
+	if byts, err := os.ReadFile(r.GoWork + ".sum"); err == nil {
+		return os.WriteFile(r.outputFile(r.GoWork+".sum"), byts, 0644)
+	}
+	return nil
+}
 
-	byts, err = r.rewriteGoMod(gomod, byts)
-	return os.WriteFile(filepath.Join(r.OutputDir, "go.mod"), byts, 0)
+// outputFile returns where the copy of path, a file under r.Pwd, goes.
+func (r *Rewriter) outputFile(path string) string {
+	return filepath.Join(r.OutputDir, strings.TrimPrefix(path, r.Pwd+"/"))
 }
 
 func (r *Rewriter) rewriteGoMod(gomod string, data []byte) ([]byte, error) {
@@ -718,20 +1050,87 @@ func (r *Rewriter) rewriteGoMod(gomod string, data []byte) ([]byte, error) {
 	}
 
 	// Update all "replace" directives that use relative paths with absolute
-	// paths.
+	// paths, unless they point at a module that's copied too.
 	for _, replace := range file.Replace {
-		if _, err := os.Stat(filepath.Join(r.Pwd, replace.New.Path)); err != nil {
-			// Not a file
-			continue
-		}
-		absPath, err := filepath.Abs(filepath.Join(r.Pwd, replace.New.Path))
+		newPath, ok, err := r.relocatePath(filepath.Dir(gomod), replace.New.Path)
 		if err != nil {
 			return nil, err
 		}
+		if !ok {
+			// Not a file
+			continue
+		}
 		file.AddReplace(replace.Old.Path, replace.Old.Version,
-			absPath, replace.New.Version)
+			newPath, replace.New.Version)
 	}
 
 	b, err := file.Format()
 	return b, err
 }
+
+func (r *Rewriter) rewriteGoWork(gowork string, data []byte) ([]byte, error) {
+	file, err := modfile.ParseWork(gowork, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dropping a use changes file.Use.
+	uses := append([]*modfile.Use(nil), file.Use...)
+	for _, use := range uses {
+		newPath, ok, err := r.relocatePath(filepath.Dir(gowork), use.Path)
+		if err != nil {
+			return nil, err
+		}
+		if ok && newPath != use.Path {
+			file.DropUse(use.Path)
+			file.AddUse(newPath, use.ModulePath)
+		}
+	}
+	for _, replace := range file.Replace {
+		newPath, ok, err := r.relocatePath(filepath.Dir(gowork), replace.New.Path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			file.AddReplace(replace.Old.Path, replace.Old.Version,
+				newPath, replace.New.Version)
+		}
+	}
+	file.Cleanup()
+	return modfile.Format(file.Syntax), nil
+}
+
+// relocatePath returns what path, a directory in a go.mod or go.work file in
+// dir, should be in the copy of that file under r.OutputDir. Paths into one
+// of r.Modules point at its copy, relative to dir, since the copies are laid
+// out as the originals are; others are made absolute. It returns false if
+// path isn't a directory.
+func (r *Rewriter) relocatePath(dir, path string) (string, bool, error) {
+	target := path
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, path)
+	}
+	if _, err := os.Stat(target); err != nil {
+		return "", false, nil
+	}
+	absPath, err := filepath.Abs(target)
+	if err != nil {
+		return "", false, err
+	}
+	for _, module := range r.Modules {
+		if absPath != module && !strings.HasPrefix(absPath, module+"/") {
+			continue
+		}
+		rel, err := filepath.Rel(dir, absPath)
+		if err != nil {
+			return "", false, err
+		}
+		// The go command only treats paths starting with ./ or ../ as
+		// relative.
+		if rel != "." && !strings.HasPrefix(rel, "..") {
+			rel = "./" + rel
+		}
+		return rel, true, nil
+	}
+	return absPath, true, nil
+}
@@ -3,6 +3,8 @@ package gotreload
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"go/ast"
 	"go/format"
 	"go/parser"
@@ -132,9 +134,9 @@ func TestCompileParse(t *testing.T) {
 
 	{
 		_, _, output, registrations := rewriteTrim("func f(a int) int { return a }")
-		assert.Contains(t, output, `func GRLx_f(a int) int { return GRLfvar_f(a) }`)
+		assert.Contains(t, output, `func GRLx_f(a int) int { if GRLfvar_f == nil { GRLfinit_f() } return GRLfvar_f(a) }`)
 		assert.Contains(t, output, `var GRLfvar_f func(a int) int`)
-		assert.Contains(t, output, `func init() { GRLfvar_f = func(a int) int { return a } }`)
+		assert.Contains(t, output, `func GRLfinit_f() { GRLfvar_f = func(a int) int { return a } }`)
 		assert.Contains(t, registrations, `"GRLfvar_f": reflect.ValueOf(&GRLfvar_f).Elem()`)
 		// t.Logf("registrations:\n%s", registrations)
 		// t.Logf("output:\n%s", output)
@@ -237,16 +239,16 @@ func F9(_ int, b float32, _ string) float32 { return b }
 		assert.Contains(t, output, "var GRLx_v8 = []int{}")
 		assert.Contains(t, output, "var GRLx_v9 = (interface{})(2)")
 
-		assert.Contains(t, registrations, `"GRLfvar_GRLx_t2_T2_method1": reflect.ValueOf(&GRLfvar_GRLx_t2_T2_method1).Elem(),`)
-		assert.Contains(t, output, "var GRLfvar_GRLx_t2_T2_method1 func(r *GRLx_t2) int")
-		assert.Contains(t, output, "func init() { GRLfvar_GRLx_t2_T2_method1 = func(r *GRLx_t2) int { return 0 } }")
+		assert.Contains(t, registrations, `"GRLfvar_t2_T2_0method1": reflect.ValueOf(&GRLfvar_t2_T2_0method1).Elem(),`)
+		assert.Contains(t, output, "var GRLfvar_t2_T2_0method1 func(r *GRLx_t2) int")
+		assert.Contains(t, output, "func GRLfinit_t2_T2_0method1() { GRLfvar_t2_T2_0method1 = func(r *GRLx_t2) int { return 0 } }")
 
-		assert.Contains(t, output, "var GRLfvar_GRLx_t2_T2_method2 func(GRLrecvr *GRLx_t2) int")
-		assert.Contains(t, output, "func init() { GRLfvar_GRLx_t2_T2_method2 = func(GRLrecvr *GRLx_t2) int { return 1 } }")
+		assert.Contains(t, output, "var GRLfvar_t2_T2_0method2 func(GRLrecvr *GRLx_t2) int")
+		assert.Contains(t, output, "func GRLfinit_t2_T2_0method2() { GRLfvar_t2_T2_0method2 = func(GRLrecvr *GRLx_t2) int { return 1 } }")
 
-		assert.Contains(t, output, "func (GRLrecvr *GRLx_t2) T2_method3(GRLarg_0, GRLarg_1, GRLarg_2 int) int { return GRLfvar_GRLx_t2_T2_method3(GRLrecvr, GRLarg_0, GRLarg_1, GRLarg_2) }")
-		assert.Contains(t, output, "var GRLfvar_GRLx_t2_T2_method3 func(GRLrecvr *GRLx_t2, _, _, _ int) int")
-		assert.Contains(t, output, "func init() { GRLfvar_GRLx_t2_T2_method3 = func(GRLrecvr *GRLx_t2, _, _, _ int) int { return 2 } }")
+		assert.Contains(t, output, "func (GRLrecvr *GRLx_t2) T2_method3(GRLarg_0, GRLarg_1, GRLarg_2 int) int { if GRLfvar_t2_T2_0method3 == nil { GRLfinit_t2_T2_0method3() } return GRLfvar_t2_T2_0method3(GRLrecvr, GRLarg_0, GRLarg_1, GRLarg_2) }")
+		assert.Contains(t, output, "var GRLfvar_t2_T2_0method3 func(GRLrecvr *GRLx_t2, _, _, _ int) int")
+		assert.Contains(t, output, "func GRLfinit_t2_T2_0method3() { GRLfvar_t2_T2_0method3 = func(GRLrecvr *GRLx_t2, _, _, _ int) int { return 2 } }")
 
 		assert.Contains(t, registrations, `"M": reflect.ValueOf((*M)(nil))`)
 		assert.Contains(t, registrations, `"ContextAlias": reflect.ValueOf((*ContextAlias)(nil))`)
@@ -264,7 +266,7 @@ func F9(_ int, b float32, _ string) float32 { return b }
 		funcEquals(r, "GRLfvar_F7", "func(ctx ContextAlias) { <-ctx.Done() var ctx2 ContextAlias _ = ctx2 }")
 		funcEquals(r, "GRLfvar_F8", "func(a int, b float32) (int, float32) { return a, b }")
 		// t.Logf("output: %s", output)
-		assert.Contains(t, output, "func F9(GRLarg_0 int, b float32, GRLarg_2 string) float32 { return GRLfvar_F9(GRLarg_0, b, GRLarg_2) }")
+		assert.Contains(t, output, "func F9(GRLarg_0 int, b float32, GRLarg_2 string) float32 { if GRLfvar_F9 == nil { GRLfinit_F9() } return GRLfvar_F9(GRLarg_0, b, GRLarg_2) }")
 		// We don't actually need synthetic arg names (GRLarg_) in the function
 		// type, or the initial function literal.
 		assert.Contains(t, output, "var GRLfvar_F9 func(_ int, b float32, _ string) float32")
@@ -316,7 +318,7 @@ type s struct {
 	// reference.
 	//
 	// So test that "internal.T_thisIsInternal" is aliased and referred to as
-	// "GRLt_internal_T_thisIsInternal" in the reloaded function.
+	// "GRLt_internal_internal_T_0thisIsInternal_h7f1e10ca" in the reloaded function.
 	{
 		_, _, output, registrations := rewriteTrim(`
 import (
@@ -333,13 +335,13 @@ func (t *T2) F(b atomic.Bool) internal_name.T_thisIsInternal { return t.f }
 		// t.Logf("registrations:\n%s", registrations)
 		assert.Contains(t, registrations, `internal_name "github.com/got-reload/got-reload/pkg/fake/internal"`)
 		assert.Contains(t, registrations, `"GRLfvar_T2_F": reflect.ValueOf(&GRLfvar_T2_F).Elem()`)
-		assert.Contains(t, registrations, "type GRLt_internal_T_thisIsInternal = internal_name.T_thisIsInternal")
+		assert.Contains(t, registrations, "type GRLt_internal_internal_T_0thisIsInternal_h7f1e10ca = internal_name.T_thisIsInternal")
 
 		// t.Logf("output:\n%s", output)
 		assert.Contains(t, output, "type T2 struct { GRLx_f internal_name.T_thisIsInternal }")
-		assert.Contains(t, output, "func (t *T2) F(b atomic.Bool) internal_name.T_thisIsInternal { return GRLfvar_T2_F(t, b) }")
+		assert.Contains(t, output, "func (t *T2) F(b atomic.Bool) internal_name.T_thisIsInternal { if GRLfvar_T2_F == nil { GRLfinit_T2_F() } return GRLfvar_T2_F(t, b) }")
 		assert.Contains(t, output, "var GRLfvar_T2_F func(t *T2, b atomic.Bool) internal_name.T_thisIsInternal")
-		assert.Contains(t, output, "func init() { GRLfvar_T2_F = func(t *T2, b atomic.Bool) internal_name.T_thisIsInternal { return t.GRLx_f } }")
+		assert.Contains(t, output, "func GRLfinit_T2_F() { GRLfvar_T2_F = func(t *T2, b atomic.Bool) internal_name.T_thisIsInternal { return t.GRLx_f } }")
 
 		// Change T2.F and reload
 		//
@@ -372,7 +374,7 @@ func (t *T2) F(b atomic.Bool) internal_name.T_thisIsInternal { return t.f + 1 }
 		assert.Contains(t, newR.NewFunc[newR.Pkgs[0].PkgPath], "GRLfvar_T2_F")
 		// t.Logf("newR.NewFunc: %#v", newR.NewFunc)
 
-		funcEquals(newR, "GRLfvar_T2_F", "func(t *T2, b atomic.Bool) GRLt_internal_T_thisIsInternal { return t.GRLx_f + 1 }")
+		funcEquals(newR, "GRLfvar_T2_F", "func(t *T2, b atomic.Bool) GRLt_internal_internal_T_0thisIsInternal_h7f1e10ca { return t.GRLx_f + 1 }")
 
 		// TODO: There could of course be multiple types with the same basename
 		// in *different* internal packages, sigh.
@@ -491,9 +493,28 @@ func (r *T) init() {}
 	}
 
 	{
-		_, _, output, _ := rewriteTrim(`func f[T any](x T) T { return x }`)
+		_, _, output, registrations := rewriteTrim(`func f[T any](x T) T { return x }`)
 		// t.Logf("registrations:\n%s", registrations)
-		assert.Contains(t, output, "func f[T any](x T) T { return x }")
+		assert.Contains(t, output, `import GRLi_generic "github.com/got-reload/got-reload/pkg/reloader/generic"`)
+		assert.Contains(t, output, "func f[T any](x T) T { "+
+			"if GRLfvar_f := GRLi_generic.Get[func(x T) T, func(T)](&GRLfvar_f); GRLfvar_f != nil { return GRLfvar_f(x) } "+
+			"return x }")
+		assert.Contains(t, output, "var GRLfvar_f GRLi_generic.Func")
+		assert.NotContains(t, output, "GRLfinit_f")
+		assert.Contains(t, registrations, `"GRLfvar_f": reflect.ValueOf(&GRLfvar_f).Elem(),`)
+	}
+
+	{
+		_, _, output, _ := rewriteTrim(`func f[K comparable, V any](m map[K]V, _ K) { clear(m) }`)
+		assert.Contains(t, output, "func f[K comparable, V any](m map[K]V, GRLarg_1 K) { "+
+			"if GRLfvar_f := GRLi_generic.Get[func(m map[K]V, _ K), func(K, V)](&GRLfvar_f); GRLfvar_f != nil { GRLfvar_f(m, GRLarg_1) return } "+
+			"clear(m) }")
+	}
+	{
+		_, _, output, _ := rewriteTrim(`type T[K any] struct{}; func (T[K]) m(k K) {}`)
+		assert.Contains(t, output, "func (GRLrecvr T[K]) GRLx_m(k K) { "+
+			"if GRLfvar_T_m := GRLi_generic.Get[func(GRLrecvr T[K], k K), func(K)](&GRLfvar_T_m); GRLfvar_T_m != nil { GRLfvar_T_m(GRLrecvr, k) return } }")
+		assert.Contains(t, output, "var GRLfvar_T_m GRLi_generic.Func")
 	}
 
 	if false {
@@ -508,6 +529,426 @@ func (r *T) init() {}
 	}
 }
 
+func TestRelocateMain(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package main
+func main() { helper() }
+func helper() {}
+`),
+		path + "/t2.go": []byte("package main"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+
+	pkg := r.Pkgs[0]
+	assert.Equal(t, "github.com/got-reload/got-reload/pkg/fake/grl_main", RelocatedPath(pkg))
+	assert.Equal(t, "grl_main", RelocatedName(pkg))
+
+	output := formatTestNode(t, pkg.Fset, pkg.Syntax[0])
+	assert.Contains(t, output, "package grl_main")
+	assert.Contains(t, output, "func Main() { if GRLfvar_main == nil { GRLfinit_main() } GRLfvar_main() }")
+	assert.Contains(t, output, "func GRLx_helper() { if GRLfvar_helper == nil { GRLfinit_helper() } GRLfvar_helper() }")
+	assert.Contains(t, output, "GRLfvar_main = func() { GRLx_helper() }")
+
+	registrations := filterWhitespace(r.Info[pkg].Registrations)
+	assert.Contains(t, registrations, "package grl_main")
+	assert.Contains(t, registrations, `"github.com/got-reload/got-reload/pkg/fake/grl_main/grl_main": {`)
+	assert.Contains(t, registrations, `"Main": reflect.ValueOf(Main)`)
+
+	assert.Contains(t, filterWhitespace(MainStub(pkg)),
+		`import grl_main "github.com/got-reload/got-reload/pkg/fake/grl_main" func main() { grl_main.Main() }`)
+}
+
+func TestLineDirectives(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+
+import "fmt"
+
+func F(x int) int {
+	fmt.Println(x)
+
+	return x + 1
+}
+
+type T struct{}
+
+func (T) M(_ string) {
+	fmt.Println("M")
+}
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+
+	pkg := r.Pkgs[0]
+	output, err := formatFile(pkg.Fset, pkg.Syntax[0])
+	require.NoError(t, err)
+	t.Logf("output:\n%s", output)
+
+	// Parse the output as if it were in the work dir, and check that what's
+	// in it is attributed to the original file.
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "/work/t1.go", output, 0)
+	require.NoError(t, err)
+	lines := map[string]int{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		var name string
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			name = "func " + n.Name.Name
+			if n.Name.Name == "init" {
+				name += " " + n.Body.List[0].(*ast.IfStmt).Cond.(*ast.BinaryExpr).X.(*ast.Ident).Name
+			}
+		case *ast.ValueSpec:
+			name = "var " + n.Names[0].Name
+		case *ast.AssignStmt:
+			name = "assign " + n.Lhs[0].(*ast.Ident).Name
+		case *ast.ExprStmt, *ast.ReturnStmt:
+			s, _, err := FormatNode(fset, n)
+			require.NoError(t, err)
+			name = s
+		default:
+			return true
+		}
+		pos := fset.Position(n.Pos())
+		assert.Equal(t, path+"/t1.go", pos.Filename, name)
+		lines[name] = pos.Line
+		return true
+	})
+	assert.Equal(t, map[string]int{
+		"func F":                          5,
+		"return GRLfvar_F(x)":             5,
+		"var GRLfvar_F":                   5,
+		"func init GRLfvar_F":             5,
+		"func init GRLfvar_T_M":           13,
+		"func GRLfinit_F":                 5,
+		"func GRLfinit_T_M":               13,
+		"GRLfinit_F()":                    5,
+		"GRLfinit_T_M()":                  13,
+		"assign GRLfvar_F":                5,
+		"fmt.Println(x)":                  6,
+		"return x + 1":                    8,
+		"func M":                          13,
+		"GRLfvar_T_M(GRLrecvr, GRLarg_0)": 13,
+		"var GRLfvar_T_M":                 13,
+		"assign GRLfvar_T_M":              13,
+		"fmt.Println(\"M\")":              14,
+	}, lines)
+}
+
+// Package-level variables are initialized before any init function runs, so
+// stubs have to be usable from their initializers, whether they call
+// rewritten functions and methods directly or not.
+func TestInitOrder(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+
+type T struct{ n int }
+
+func (t *T) get() int { return t.n }
+
+func helper() int { return (&T{n: 21}).get() }
+
+func newCount() int { return helper() * 2 }
+
+func fact(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n * fact(n-1)
+}
+
+var count = newCount()
+var get = (&T{n: 1}).get
+var viaMethodValue = get()
+var f5 = fact(5)
+var fromInterface = interface{ get() int }(&T{n: 3}).get()
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+
+	output, err := formatFile(r.Pkgs[0].Fset, r.Pkgs[0].Syntax[0])
+	require.NoError(t, err)
+
+	// Build and run it, on its own.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/go.mod", []byte("module fake\n\ngo 1.22\n"), 0644))
+	require.NoError(t, os.WriteFile(dir+"/t1.go", output, 0644))
+	require.NoError(t, os.WriteFile(dir+"/t1_test.go", []byte(`package fake
+
+import "testing"
+
+func TestInit(t *testing.T) {
+	if GRLx_count != 42 || GRLx_viaMethodValue != 1 || GRLx_f5 != 120 || GRLx_fromInterface != 3 {
+		t.Fatal(GRLx_count, GRLx_viaMethodValue, GRLx_f5, GRLx_fromInterface)
+	}
+	if GRLfvar_T_get == nil || GRLfvar_helper == nil || GRLfvar_newCount == nil || GRLfvar_fact == nil {
+		t.Fatal("unpopulated stubs")
+	}
+}
+`), 0644))
+	cmd := exec.Command("go", "test", "-count=1", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "%s\n%s", out, output)
+}
+
+func TestUnreloadable(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	load := func(src string) *Rewriter {
+		t.Helper()
+		r := NewRewriter()
+		r.Config.Overlay = map[string][]byte{
+			path + "/t1.go": []byte("package fake; " + src),
+			path + "/t2.go": []byte("package fake"),
+		}
+		err := r.Load("../fake")
+		require.NoError(t, err)
+		err = r.Rewrite(ModeRewrite, false)
+		require.NoError(t, err)
+		return r
+	}
+
+	const orig = `
+type T struct{ a int }
+func (t *T) M(i int) int { return i }
+const c = 1
+var v int
+var x, y = F(1), F(2)
+var _ = F(3)
+func init() { v = 1 }
+func F(i int) int { return i }
+`
+	r := load(orig)
+	pkgPath := r.Pkgs[0].PkgPath
+
+	// Changing only function bodies is fine.
+	newR := load(`
+type T struct{ a int }
+func (t *T) M(i int) int { return i + 1 }
+const c = 1
+var v int
+var x, y = F(1), F(2)
+var _ = F(3)
+func init() { v = 1 }
+func F(i int) int { return i * 2 }
+`)
+	assert.Empty(t, r.Unreloadable(newR, pkgPath))
+
+	// Initialization has already run, and removed declarations would be
+	// left behind.
+	newR = load(`
+type T struct{ a int }
+const c = 1
+var v = 2
+var x, y = F(1), F(4)
+var _ = F(5)
+func init() { v = 2 }
+func F(i int) int { return i }
+`)
+	assert.Equal(t, []string{
+		"init functions changed",
+		"initializer of a blank variable changed",
+		"initializer of variable v changed",
+		"initializer of variable y changed",
+		"removed method T.M",
+	}, r.Unreloadable(newR, pkgPath))
+	newR = load(`
+type T struct{ a int }
+func (t *T) M(i int) int { return i }
+var v int
+var x, y int
+`)
+	assert.Equal(t, []string{
+		"init functions changed",
+		"initializer of a blank variable removed",
+		"initializer of variable x removed",
+		"initializer of variable y removed",
+		"removed constant c",
+		"removed function F",
+	}, r.Unreloadable(newR, pkgPath))
+
+	newR = load(`
+type T struct{ a, b int }
+func (t *T) M(i int) string { return "" }
+func (t *T) N() {}
+const c = 2
+var v, w int
+var x, y = F(1, 0), F(2, 0)
+var _ = F(3, 0)
+func init() { v = 1 }
+func F(i, j int) int { return i }
+func G() {}
+`)
+	assert.Equal(t, []string{
+		"definition of type T changed",
+		"initializer of a blank variable changed",
+		"initializer of variable x changed",
+		"initializer of variable y changed",
+		"new variable w",
+		"signature of F changed",
+		"signature of T.M changed",
+		"value of constant c changed",
+	}, r.Unreloadable(newR, pkgPath))
+
+	// New functions and methods can be added, unless they're generic, or
+	// excluded, or compiled code uses them.
+	newR = load(orig + `
+func (t *T) N() int { return t.a }
+func G() int { return g() }
+func g() int { return 1 }
+`)
+	assert.Empty(t, r.Unreloadable(newR, pkgPath))
+	newR = load(orig + `
+var w = G
+func G() int { return 1 }
+func H[X any](x X) X { return x }
+` + SkipDirective + `
+func I() {}
+`)
+	assert.Equal(t, []string{
+		"new function G is used by compiled code at t1.go:11",
+		"new function I is excluded from reloading",
+		"new generic function H",
+		"new variable w",
+	}, r.Unreloadable(newR, pkgPath))
+
+	// Instantiations of generics from other packages are registered as the
+	// program is built.
+	r = load(`import "slices"; func F(s []int) int { return slices.Index(s, 1) }`)
+	newR = load(`import "slices"; func F(s []int) int { return slices.Index(s, 2) }`)
+	assert.Empty(t, r.Unreloadable(newR, pkgPath))
+	newR = load(`import "slices"; func F(s []string) int { return slices.Index(s, "") }`)
+	assert.Equal(t, []string{
+		"new instantiation slices.Index[[]string, string]",
+		"signature of F changed",
+	}, r.Unreloadable(newR, pkgPath))
+}
+
+func TestInstances(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+import (
+	"slices"
+	"sync/atomic"
+)
+type point struct{ x int }
+var last atomic.Pointer[point]
+func f(pts []point) int { return slices.Index(pts, point{}) + slices.Index[[]int](nil, 1) }
+func g[T any](s []T) { slices.Reverse(s) }
+func h() int { type local int; return slices.Index([]local{}, 1) }
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+	pkg := r.Pkgs[0]
+
+	registrations := string(r.Info[pkg].Registrations)
+	assert.Contains(t, registrations, `"slices/slices": {`)
+	assert.Regexp(t, `"GRLg_Index_h[0-9a-f]{8}": +reflect.ValueOf\(slices.Index\[\[\]GRLx_point, GRLx_point\]\)`, registrations)
+	assert.Regexp(t, `"GRLg_Index_h[0-9a-f]{8}": +reflect.ValueOf\(slices.Index\[\[\]int, int\]\)`, registrations)
+	assert.Contains(t, registrations, `"sync/atomic/atomic": {`)
+	assert.Regexp(t, `"GRLg_Pointer_h[0-9a-f]{8}": +reflect.ValueOf\(\(\*atomic.Pointer\[GRLx_point\]\)\(nil\)\)`, registrations)
+	// Neither type parameters nor local types can be registered.
+	assert.NotContains(t, registrations, "Reverse")
+	assert.NotContains(t, registrations, "local")
+
+	// Reloaded code refers to them by those names.
+	err = r.Rewrite(ModeReload, false)
+	require.NoError(t, err)
+	def, err := r.FuncDef(pkg.PkgPath, "GRLfvar_f")
+	require.NoError(t, err)
+	assert.Regexp(t, `return slices.GRLg_Index_h[0-9a-f]{8}\(pts, GRLx_point\{\}\) \+ slices.GRLg_Index_h[0-9a-f]{8}\(nil, 1\)`, def)
+	def, err = r.FuncDef(pkg.PkgPath, "GRLfvar_h")
+	require.NoError(t, err)
+	assert.Contains(t, def, "slices.Index([]local{}, 1)")
+}
+
+func TestCheck(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+type T struct{}
+func F() {}
+func init() {}
+func G[X any](x X) X { return x }
+func (t *T) Loop(ch chan int) {
+	for {
+		for range ch {
+			break
+		}
+	}
+}
+func (t T) Loop2(ch chan int) {
+outer:
+	for {
+		for range ch {
+			break outer
+		}
+	}
+}
+func Block() { select {} }
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+
+	reasons := map[string][]string{}
+	for _, report := range r.Check() {
+		reasons[report.Name] = report.Reasons
+		assert.Equal(t, len(report.Reasons) == 0, report.Reloadable, report.Name)
+	}
+	assert.Empty(t, reasons["F"])
+	assert.Equal(t, []string{"init function"}, reasons["init"])
+	assert.Empty(t, reasons["G"])
+	assert.Len(t, reasons["(*T).Loop"], 1)
+	assert.Contains(t, reasons["(*T).Loop"][0], "never returns")
+	assert.Empty(t, reasons["T.Loop2"])
+	assert.Len(t, reasons["Block"], 1)
+}
+
 func formatTestNode(t *testing.T, fset *token.FileSet, node ast.Node) string {
 	if node == nil || node == (*ast.FuncLit)(nil) {
 		return ""
@@ -690,6 +1131,39 @@ require (
 	assert.Contains(t, string(byts), "replace github.com/traefik/yaegi => /")
 }
 
+func TestRewriteGoWork(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	for _, dir := range []string{"app", "lib", "tools"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+
+	r := NewRewriter()
+	r.Pwd = root
+	r.OutputDir = "/tmp/got-reload"
+	// tools is part of the workspace, but not copied.
+	r.Modules = []string{filepath.Join(root, "app"), filepath.Join(root, "lib")}
+
+	gowork := filepath.Join(root, "go.work")
+	byts, err := r.rewriteGoWork(gowork, []byte(`go 1.22.1
+
+use (
+	./app
+	./lib
+	./tools
+)
+
+replace example.com/other => `+other+`
+replace example.com/lib v1.0.0 => `+filepath.Join(root, "lib")+`
+`))
+	require.NoError(t, err)
+	assert.Contains(t, string(byts), "./app\n")
+	assert.Contains(t, string(byts), "./lib\n")
+	assert.Contains(t, string(byts), filepath.Join(root, "tools")+"\n")
+	assert.Contains(t, string(byts), "example.com/other => "+other+"\n")
+	assert.Contains(t, string(byts), "example.com/lib v1.0.0 => ./lib\n")
+}
+
 var (
 	// Parse this and print out its AST to figure out what to generate for the
 	// rewritten functions.
@@ -796,3 +1270,371 @@ func example() {
 }
 `)
 )
+
+func TestExclude(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	newRewriter := func(hot string) *Rewriter {
+		r := NewRewriter()
+		r.Config.Overlay = map[string][]byte{
+			path + "/t1.go": []byte(`package fake
+type T struct{}
+func F() {}
+func hot() {` + hot + `}
+func (t *T) M() {}
+//got-reload:skip
+func skipped() {}
+`),
+			path + "/t2.go": []byte(`package fake
+func G() { hot() }
+`),
+			path + "/t3.go": []byte(`// Code generated by hand. DO NOT EDIT.
+
+package fake
+func H() {}
+`),
+			path + "/t4.go": []byte(`//got-reload:skip
+
+package fake
+func I() {}
+`),
+		}
+		r.ExcludeFiles = []string{"t2.*"}
+		r.ExcludeFuncs = []*regexp.Regexp{regexp.MustCompile(`^hot$`), regexp.MustCompile(`^\(\*T\)\.`)}
+		err = r.Load("../fake")
+		require.NoError(t, err)
+		return r
+	}
+
+	r := newRewriter("")
+	reasons := map[string][]string{}
+	for _, report := range r.Check() {
+		reasons[report.Name] = report.Reasons
+	}
+	assert.Equal(t, map[string][]string{
+		"F":       nil,
+		"hot":     {`excluded: name matches "^hot$"`},
+		"(*T).M":  {`excluded: name matches "^\\(\\*T\\)\\."`},
+		"skipped": {"excluded: //got-reload:skip"},
+		"G":       {`excluded: file matches "t2.*"`},
+		"H":       {"excluded: generated file"},
+		"I":       {"excluded: file has //got-reload:skip"},
+	}, reasons)
+
+	err = r.Rewrite(ModeRewrite, false)
+	require.NoError(t, err)
+
+	var stubVars []string
+	for stubVar := range r.NewFunc[r.Pkgs[0].PkgPath] {
+		stubVars = append(stubVars, stubVar)
+	}
+	assert.Equal(t, []string{"GRLfvar_F"}, stubVars)
+
+	// Excluded functions are left alone, but still exported.
+	output := formatTestNode(t, r.Pkgs[0].Fset, r.Pkgs[0].Syntax[0])
+	assert.Contains(t, output, "func GRLx_hot() {}")
+	assert.Contains(t, output, "func (t *T) M() {}")
+	output = formatTestNode(t, r.Pkgs[0].Fset, r.Pkgs[0].Syntax[1])
+	assert.Contains(t, output, "func G() { GRLx_hot() }")
+
+	// Changing an excluded function needs a restart.
+	newR := newRewriter("println()")
+	err = newR.Rewrite(ModeRewrite, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hot changed, but is excluded from reloading"},
+		r.Unreloadable(newR, r.Pkgs[0].PkgPath))
+}
+
+func TestTests(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Tests = true
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+func F() {}
+`),
+		path + "/t2.go": []byte("package fake"),
+		path + "/t1_test.go": []byte(`package fake
+import "testing"
+func helper() { F() }
+func TestF(t *testing.T) { helper() }
+`),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	require.Len(t, r.Pkgs, 1)
+	pkg := r.Pkgs[0]
+	assert.Equal(t, "github.com/got-reload/got-reload/pkg/fake [github.com/got-reload/got-reload/pkg/fake.test]", pkg.ID)
+
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+	assert.Contains(t, r.NewFunc[pkg.PkgPath], "GRLfvar_helper")
+
+	// Test symbols are registered separately from the rest.
+	registrations := filterWhitespace(r.Info[pkg].Registrations)
+	assert.Contains(t, registrations, `"F": reflect.ValueOf(F)`)
+	assert.NotContains(t, registrations, "helper")
+	testRegistrations := filterWhitespace(r.Info[pkg].TestRegistrations)
+	assert.Contains(t, testRegistrations, `"GRLx_helper": reflect.ValueOf(GRLx_helper)`)
+	assert.Contains(t, testRegistrations, `"GRLfvar_helper": reflect.ValueOf(&GRLfvar_helper).Elem()`)
+	assert.NotContains(t, testRegistrations, `"F"`)
+}
+
+func TestDiagTranslator(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+var count int
+type t struct{}
+func (*t) m(_ int) { count++ }
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+	manifest := r.Info[r.Pkgs[0]].Manifest
+	assert.Equal(t, Renames{
+		"GRLx_count":   "count",
+		"GRLx_t":       "t",
+		"GRLx_m":       "m",
+		"GRLfvar_t_m":  "(*t).m",
+		"GRLfinit_t_m": "(*t).m",
+	}, manifest.Renames())
+
+	outputDir := t.TempDir()
+	byts, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(outputDir+"/p", 0755))
+	require.NoError(t, os.WriteFile(outputDir+"/p/"+ManifestFileName(r.Pkgs[0]), byts, 0644))
+
+	d := &DiagTranslator{OutputDir: outputDir, SrcRoot: "/src", Dir: outputDir, Cwd: "/src"}
+	for line, expected := range map[string]string{
+		"# example.com/m/grl_main":           "# example.com/m",
+		"p/t1.go:4:2: undefined: GRLx_count": "p/t1.go:4:2: undefined: count",
+		"/src/p/t1.go:4: x.GRLx_m undefined (type *GRLx_t has no field or method GRLx_m)": "p/t1.go:4: x.m undefined (type *t has no field or method m)",
+		"/src/main.go:3: cannot use GRLarg_0 (variable of type int) as string value":      "./main.go:3: cannot use _ (variable of type int) as string value" + IntroducedNote,
+		"p/grl_register.go:9:3: GRLfvar_t_m redeclared in this block":                     outputDir + "/p/grl_register.go:9:3: <stub for (*t).m> redeclared in this block" + IntroducedNote,
+		"grl_main/main.go:7:2: undefined: GRLx_helper":                                    "./main.go:7:2: undefined: helper",
+		"/usr/lib/go/src/fmt/print.go:10: not ours":                                       "/usr/lib/go/src/fmt/print.go:10: not ours",
+	} {
+		assert.Equal(t, expected, d.Translate(line), line)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+
+const C = 1
+
+type t struct{ f int }
+
+func (_ t) M(_ string) {}
+
+func (x *t) m() int { return x.f }
+
+func init() {}
+
+func F(int) {}
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+
+	m := r.Info[r.Pkgs[0]].Manifest
+	assert.Equal(t, "github.com/got-reload/got-reload/pkg/fake", m.Path)
+	assert.Equal(t, "fake", m.RelocatedName)
+	pos := func(line, col int) string { return fmt.Sprintf("%s/t1.go:%d:%d", path, line, col) }
+	assert.Equal(t, []ManifestIdent{
+		{Orig: "C", New: "C", Kind: KindConst, Pos: pos(3, 7)},
+		{Orig: "t", New: "GRLx_t", Kind: KindType, Pos: pos(5, 6)},
+		{New: "GRLfinit_t_M", Kind: KindStubInit, Pos: pos(7, 1), Func: "t.M"},
+		{New: "GRLfvar_t_M", Kind: KindStub, Pos: pos(7, 1), Func: "t.M"},
+		{Orig: "_", New: "GRLrecvr", Kind: KindReceiver, Pos: pos(7, 7), Func: "t.M"},
+		{Orig: "M", New: "M", Kind: KindMethod, Pos: pos(7, 12), Stub: "GRLfvar_t_M"},
+		{Orig: "_", New: "GRLarg_0", Kind: KindArg, Pos: pos(7, 14), Func: "t.M"},
+		{New: "GRLfinit_t_m", Kind: KindStubInit, Pos: pos(9, 1), Func: "(*t).m"},
+		{New: "GRLfvar_t_m", Kind: KindStub, Pos: pos(9, 1), Func: "(*t).m"},
+		{Orig: "m", New: "GRLx_m", Kind: KindMethod, Pos: pos(9, 13), Stub: "GRLfvar_t_m"},
+		{New: "GRLfinit_F", Kind: KindStubInit, Pos: pos(13, 1), Func: "F"},
+		{New: "GRLfvar_F", Kind: KindStub, Pos: pos(13, 1), Func: "F"},
+		{Orig: "F", New: "F", Kind: KindFunc, Pos: pos(13, 6), Stub: "GRLfvar_F"},
+		{New: "GRLarg_0", Kind: KindArg, Pos: pos(13, 8), Func: "F"},
+	}, m.Idents)
+}
+
+func TestStubNames(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+type T struct{}
+type T_ struct{}
+func (T) m() {}
+func (T_) m() {}
+func T_m() {}
+func T__m() {}
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+
+	stubs := r.Info[r.Pkgs[0]].Manifest.Renames()
+	assert.Equal(t, "T.m", stubs["GRLfvar_T_m"])
+	assert.Equal(t, "T_.m", stubs["GRLfvar_T_0_m"])
+	assert.Equal(t, "T_m", stubs["GRLfvar_T_0m"])
+	assert.Equal(t, "T__m", stubs["GRLfvar_T_0_0m"])
+
+	r = NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+var GRLx_v int
+func f(GRLarg_0 int) {}
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "reserves")
+	assert.Contains(t, err.Error(), path+"/t1.go:2:5: GRLx_v")
+	assert.Contains(t, err.Error(), path+"/t1.go:3:8: GRLarg_0")
+}
+
+func TestGenericFuncDef(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+func Map[T, U any](s []T, f func(T) U) []U {
+	r := make([]U, 0, len(s))
+	for _, v := range s {
+		r = append(r, f(v))
+	}
+	return r
+}
+type Pair[K comparable, V any] struct{ k K; v V }
+func (p *Pair[K, _]) Key() K { return p.k }
+func f() {}
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, true)
+	require.NoError(t, err)
+	pkgPath := r.Pkgs[0].PkgPath
+
+	assert.True(t, r.IsGeneric(pkgPath, "GRLfvar_Map"))
+	assert.False(t, r.IsGeneric(pkgPath, "GRLfvar_f"))
+	_, _, err = r.GenericFuncDef(pkgPath, "GRLfvar_f")
+	assert.Error(t, err)
+
+	def, method, err := r.GenericFuncDef(pkgPath, "GRLfvar_Map")
+	require.NoError(t, err)
+	assert.False(t, method)
+	assert.Contains(t, def, "func(s []GRLt_arg0, f func(GRLt_arg0) GRLt_arg1) []GRLt_arg1 {")
+	assert.Contains(t, def, "make([]GRLt_arg1, 0, len(s))")
+
+	// The function's own definition is left alone.
+	orig, err := r.FuncDef(pkgPath, "GRLfvar_Map")
+	require.NoError(t, err)
+	assert.Contains(t, orig, "func(s []T, f func(T) U) []U {")
+
+	inst := InstantiateFuncDef(def, []string{"int", "*string"}, "")
+	assert.Contains(t, inst, "func(s []int, f func(int) (*string)) [](*string) {")
+	assert.Contains(t, inst, "make([](*string), 0, len(s))")
+
+	// The receiver's type parameters are the method's, and its base type is
+	// left to the reloader.
+	assert.True(t, r.IsGeneric(pkgPath, "GRLfvar_Pair_Key"))
+	def, method, err = r.GenericFuncDef(pkgPath, "GRLfvar_Pair_Key")
+	require.NoError(t, err)
+	assert.True(t, method)
+	assert.Contains(t, def, "func(p *GRLt_recv) GRLt_arg0 {")
+	assert.Contains(t, def, "return p.GRLx_k")
+	inst = InstantiateFuncDef(def, []string{"string", "int"}, "grl_inst.T0")
+	assert.Contains(t, inst, "func(p *grl_inst.T0) string {")
+
+	orig, err = r.FuncDef(pkgPath, "GRLfvar_Pair_Key")
+	require.NoError(t, err)
+	assert.Contains(t, orig, "func(p *Pair[K, GRLt_param1]) K {")
+}
+
+func TestCallMethodStubs(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	path := path.Dir(cwd) + "/fake"
+
+	r := NewRewriter()
+	r.Config.Overlay = map[string][]byte{
+		path + "/t1.go": []byte(`package fake
+type T struct{ a int }
+func (t *T) inc(n int) { t.a += n }
+func (t T) get() int { return t.a }
+type U struct{ *T }
+func f(t T, p *T, u U) int {
+	t.inc(1)
+	p.inc(2)
+	u.inc(3)
+	g := T.get
+	return p.get() + g(t)
+}
+`),
+		path + "/t2.go": []byte("package fake"),
+	}
+	err = r.Load("../fake")
+	require.NoError(t, err)
+	err = r.Rewrite(ModeRewrite, false)
+	require.NoError(t, err)
+	err = r.Rewrite(ModeReload, false)
+	require.NoError(t, err)
+	pkgPath := r.Pkgs[0].PkgPath
+
+	name, method, err := r.StubbedFunc(pkgPath, "GRLfvar_T_inc")
+	require.NoError(t, err)
+	assert.Equal(t, "GRLx_inc", name)
+	assert.True(t, method)
+	name, method, err = r.StubbedFunc(pkgPath, "GRLfvar_f")
+	require.NoError(t, err)
+	assert.Equal(t, "GRLx_f", name)
+	assert.False(t, method)
+
+	r.CallMethodStubs(pkgPath, map[string]bool{"GRLfvar_T_inc": true, "GRLfvar_T_get": true})
+	def, err := r.FuncDef(pkgPath, "GRLfvar_f")
+	require.NoError(t, err)
+	assert.Contains(t, def, "GRLfvar_T_inc(&t, 1)")
+	assert.Contains(t, def, "GRLfvar_T_inc(p, 2)")
+	assert.Contains(t, def, "GRLfvar_T_inc(u.T, 3)")
+	assert.Contains(t, def, "g := GRLfvar_T_get")
+	assert.Contains(t, def, "return GRLfvar_T_get(*p) + g(t)")
+}
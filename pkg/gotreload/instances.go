@@ -0,0 +1,219 @@
+package gotreload
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/got-reload/got-reload/pkg/extract"
+	"golang.org/x/tools/go/packages"
+)
+
+// The interpreter can't instantiate compiled generic functions and types, so
+// a package's registrations include each concrete instantiation it makes of
+// those from other packages, under a name of its own (see instanceName), in
+// the generic's package, and reloaded code refers to them by those names
+// instead.
+
+// An instance is an instantiation of a generic function or type from another
+// package.
+type instance struct {
+	// What's registered, and its registration key: the generic's package.
+	extract.Instance
+	Key string
+	// How it's written in the original source, more or less.
+	orig string
+}
+
+// String returns inst as it's written in the original source, more or less.
+func (inst instance) String() string {
+	return inst.orig
+}
+
+// instances returns the instantiations of generic functions and types from
+// other packages that pkg makes, by the identifiers that make them, adding
+// the packages that their registrations need to imports. Those that can't be
+// registered, e.g. because a type argument is a type parameter or a local
+// type, are left out.
+func instances(pkg *packages.Package, imports *extract.ImportTracker) map[*ast.Ident]instance {
+	insts := map[*ast.Ident]instance{}
+	for ident, inst := range pkg.TypesInfo.Instances {
+		obj := pkg.TypesInfo.Uses[ident]
+		if obj == nil || obj.Pkg() == nil || obj.Pkg() == pkg.Types || !obj.Exported() ||
+			pkg.Imports[obj.Pkg().Path()] == nil {
+
+			continue
+		}
+		namer := &instanceNamer{pkg: pkg, imports: imports}
+		var typeArgs, ids, origs []string
+		for i := 0; i < inst.TypeArgs.Len(); i++ {
+			typeArg := inst.TypeArgs.At(i)
+			typeArgs = append(typeArgs, namer.typeExpr(typeArg))
+			ids = append(ids, types.TypeString(typeArg, nil))
+			origs = append(origs, types.TypeString(typeArg, types.RelativeTo(pkg.Types)))
+		}
+		if namer.err != nil {
+			continue
+		}
+		_, isType := obj.(*types.TypeName)
+		objPath := obj.Pkg().Path()
+		expr := obj.Name() + "[" + strings.Join(typeArgs, ", ") + "]"
+		if alias := imports.GetAlias(obj.Pkg().Name(), objPath); alias != "" {
+			expr = alias + "." + expr
+		}
+		insts[ident] = instance{
+			Instance: extract.Instance{
+				Name: instanceName(obj, ids),
+				Expr: expr,
+				Type: isType,
+			},
+			Key:  objPath + "/" + path.Base(objPath),
+			orig: obj.Pkg().Name() + "." + obj.Name() + "[" + strings.Join(origs, ", ") + "]",
+		}
+	}
+	return insts
+}
+
+// instanceIdent returns the identifier that names x, an instantiated generic,
+// e.g. "F" in "pkg.F[T]", if it's one.
+func instanceIdent(x ast.Expr) *ast.Ident {
+	switch x := x.(type) {
+	case *ast.Ident:
+		return x
+	case *ast.SelectorExpr:
+		return x.Sel
+	}
+	return nil
+}
+
+// registeredInstances returns insts, as instances returns them, grouped by
+// registration key, for extract.GenContentIncluding, keeping only those
+// whose identifiers are in files that include returns true for.
+func registeredInstances(pkg *packages.Package, insts map[*ast.Ident]instance, include func(filename string) bool) map[string][]extract.Instance {
+	byKey := map[string]map[string]extract.Instance{}
+	for ident, inst := range insts {
+		if !include(pkg.Fset.Position(ident.Pos()).Filename) {
+			continue
+		}
+		if byKey[inst.Key] == nil {
+			byKey[inst.Key] = map[string]extract.Instance{}
+		}
+		byKey[inst.Key][inst.Name] = inst.Instance
+	}
+	registered := map[string][]extract.Instance{}
+	for key, byName := range byKey {
+		for _, inst := range byName {
+			registered[key] = append(registered[key], inst)
+		}
+		sort.Slice(registered[key], func(i, j int) bool { return registered[key][i].Name < registered[key][j].Name })
+	}
+	return registered
+}
+
+// instanceName returns the name that the instantiation of obj, a generic
+// function or type, with the type arguments typeIDs, is registered as:
+// instancePrefix, obj's name, and a hash of typeIDs, which are the type
+// arguments' types.TypeStrings, fully qualified.
+func instanceName(obj types.Object, typeIDs []string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(typeIDs, ";")))
+	return instancePrefix + mangle(obj.Name(), fmt.Sprintf("h%08x", h.Sum32()))
+}
+
+// An instanceNamer writes type arguments as they're named in pkg's filtered
+// code, and notes in err any it can't.
+type instanceNamer struct {
+	pkg     *packages.Package
+	imports *extract.ImportTracker
+	err     error
+}
+
+// typeExpr returns a Go expression for t, adding the packages it needs to
+// n.imports.
+func (n *instanceNamer) typeExpr(t types.Type) string {
+	switch t := types.Unalias(t).(type) {
+	case *types.Basic:
+		return t.Name()
+	case *types.Named:
+		obj := t.Obj()
+		var name string
+		switch {
+		case obj.Pkg() == nil:
+			// error
+			name = obj.Name()
+		case obj.Parent() != obj.Pkg().Scope():
+			n.err = fmt.Errorf("%s is local", obj.Name())
+			return ""
+		case obj.Pkg() == n.pkg.Types:
+			name = obj.Name()
+			if !obj.Exported() {
+				name = exportPrefix + name
+			}
+		case !obj.Exported() || n.pkg.Imports[obj.Pkg().Path()] == nil:
+			n.err = fmt.Errorf("%s.%s can't be named", obj.Pkg().Path(), obj.Name())
+			return ""
+		default:
+			name = n.imports.GetAlias(obj.Pkg().Name(), obj.Pkg().Path()) + "." + obj.Name()
+		}
+		if t.TypeArgs().Len() > 0 {
+			var typeArgs []string
+			for i := 0; i < t.TypeArgs().Len(); i++ {
+				typeArgs = append(typeArgs, n.typeExpr(t.TypeArgs().At(i)))
+			}
+			name += "[" + strings.Join(typeArgs, ", ") + "]"
+		}
+		return name
+	case *types.Pointer:
+		return "*" + n.typeExpr(t.Elem())
+	case *types.Slice:
+		return "[]" + n.typeExpr(t.Elem())
+	case *types.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), n.typeExpr(t.Elem()))
+	case *types.Map:
+		return "map[" + n.typeExpr(t.Key()) + "]" + n.typeExpr(t.Elem())
+	case *types.Chan:
+		elem := n.typeExpr(t.Elem())
+		if strings.HasPrefix(elem, "<-") {
+			elem = "(" + elem + ")"
+		}
+		switch t.Dir() {
+		case types.RecvOnly:
+			return "<-chan " + elem
+		case types.SendOnly:
+			return "chan<- " + elem
+		}
+		return "chan " + elem
+	case *types.Signature:
+		tuple := func(vars *types.Tuple, variadic bool) []string {
+			var list []string
+			for i := 0; i < vars.Len(); i++ {
+				s := n.typeExpr(vars.At(i).Type())
+				if variadic && i == vars.Len()-1 {
+					s = "..." + strings.TrimPrefix(s, "[]")
+				}
+				list = append(list, s)
+			}
+			return list
+		}
+		s := "func(" + strings.Join(tuple(t.Params(), t.Variadic()), ", ") + ")"
+		switch results := tuple(t.Results(), false); len(results) {
+		case 0:
+		case 1:
+			s += " " + results[0]
+		default:
+			s += " (" + strings.Join(results, ", ") + ")"
+		}
+		return s
+	case *types.Interface:
+		if t.Empty() {
+			return "interface{}"
+		}
+	}
+	// Including structs, whose unexported fields the filter renames.
+	n.err = fmt.Errorf("%s can't be named", t)
+	return ""
+}
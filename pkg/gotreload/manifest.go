@@ -0,0 +1,212 @@
+package gotreload
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// A Manifest records how rewriting renamed a package's identifiers, so that
+// editors, debuggers, error translators and scripts can resolve names
+// between the original source and the filtered code, in either direction.
+// WritePkg writes it as JSON, to ManifestFileName(pkg) next to the package's
+// filtered files.
+type Manifest struct {
+	// The package's import path and name, and those it has after filtering,
+	// which differ only for a relocated package main.
+	Path          string `json:"path"`
+	Name          string `json:"name"`
+	RelocatedPath string `json:"relocatedPath"`
+	RelocatedName string `json:"relocatedName"`
+	// The package's identifiers, in source order.
+	Idents []ManifestIdent `json:"idents"`
+}
+
+// A ManifestIdent is an identifier in a Manifest: every package-level one in
+// the original source, renamed or not, and every one rewriting introduced.
+type ManifestIdent struct {
+	// The identifier in the original source, and in the filtered code. Orig
+	// is empty for stub variables and their initializers, and for synthetic arguments and receivers
+	// that had no name, which have no counterpart in the original. It's
+	// "pkg.T" for the alias of an internal type.
+	Orig string    `json:"orig"`
+	New  string    `json:"new"`
+	Kind IdentKind `json:"kind"`
+	// Where it's declared in the original source, as "file:line:column":
+	// for stub variables, the function they back, and for synthetic
+	// arguments and receivers that had no name, their types.
+	Pos string `json:"pos"`
+	// For a function or method, the stub variable that backs it, if it
+	// was stubbed.
+	Stub string `json:"stub,omitempty"`
+	// For a stub variable or its initializer, or a synthetic argument or
+	// receiver, its function or method, as "F", "T.M" or "(*T).M".
+	Func string `json:"func,omitempty"`
+	// For the alias of an internal type, the import path of the type's
+	// package.
+	Pkg string `json:"pkg,omitempty"`
+}
+
+// IdentKind is the kind of a ManifestIdent.
+type IdentKind string
+
+const (
+	KindConst  IdentKind = "const"
+	KindVar    IdentKind = "var"
+	KindType   IdentKind = "type"
+	KindFunc   IdentKind = "func"
+	KindMethod IdentKind = "method"
+	// The variable that holds a stubbed function's body, and the function
+	// that populates it.
+	KindStub     IdentKind = "stub"
+	KindStubInit IdentKind = "stub init"
+	// Names given to unnamed or "_" arguments and receivers of stubbed
+	// functions, to pass them on to the stub.
+	KindArg      IdentKind = "arg"
+	KindReceiver IdentKind = "receiver"
+	// A non-internal alias of a type from an internal package, which the
+	// reloader can refer to.
+	KindInternalType IdentKind = "internal type"
+)
+
+// ManifestFileName returns the name of the file that holds pkg's Manifest.
+func ManifestFileName(pkg *packages.Package) string {
+	if strings.HasSuffix(pkg.Name, "_test") {
+		return "grl_manifest_x_test.json"
+	}
+	return "grl_manifest.json"
+}
+
+// newManifest returns pkg's Manifest, once it's rewritten, given its stubbed
+// functions, with their stub variables, and the internal types it needs
+// aliases of, by alias.
+func newManifest(pkg *packages.Package, stubs map[*ast.FuncDecl]string, internalTypes map[string]*types.TypeName) *Manifest {
+	type posIdent struct {
+		pos   token.Pos
+		ident ManifestIdent
+	}
+	var idents []posIdent
+	add := func(pos token.Pos, ident ManifestIdent) {
+		ident.Pos = pkg.Fset.Position(pos).String()
+		idents = append(idents, posIdent{pos, ident})
+	}
+
+	stubsByName := map[*ast.Ident]string{}
+	for funcDecl, stub := range stubs {
+		stubsByName[funcDecl.Name] = stub
+		funcName := origFuncName(pkg, funcDecl)
+		add(funcDecl.Pos(), ManifestIdent{New: stub, Kind: KindStub, Func: funcName})
+		// Generic functions' stubs need no initializer.
+		if !isGeneric(funcDecl) {
+			add(funcDecl.Pos(), ManifestIdent{New: stubInitPrefix + strings.TrimPrefix(stub, stubPrefix), Kind: KindStubInit, Func: funcName})
+		}
+
+		fields := funcDecl.Type.Params.List
+		if funcDecl.Recv != nil {
+			fields = append(funcDecl.Recv.List[:1:1], fields...)
+		}
+		for _, field := range fields {
+			for _, name := range field.Names {
+				kind := KindArg
+				if name.Name == syntheticReceiver {
+					kind = KindReceiver
+				} else if !strings.HasPrefix(name.Name, syntheticArgPrefix) {
+					continue
+				}
+				// "_" names are renamed in place, and unnamed ones get
+				// new identifiers, with no position.
+				ident := ManifestIdent{New: name.Name, Kind: kind, Func: funcName}
+				pos := name.Pos()
+				if pos.IsValid() {
+					ident.Orig = "_"
+				} else {
+					pos = field.Type.Pos()
+				}
+				add(pos, ident)
+			}
+		}
+	}
+
+	for ident, obj := range pkg.TypesInfo.Defs {
+		if obj == nil || obj.Pkg() != pkg.Types || obj.Name() == "_" {
+			continue
+		}
+		var kind IdentKind
+		switch obj := obj.(type) {
+		case *types.Const:
+			kind = KindConst
+		case *types.Var:
+			kind = KindVar
+		case *types.TypeName:
+			kind = KindType
+		case *types.Func:
+			recv := obj.Type().(*types.Signature).Recv()
+			switch {
+			case recv == nil && obj.Name() == "init":
+				continue
+			case recv == nil:
+				kind = KindFunc
+			case types.IsInterface(recv.Type()):
+				continue
+			default:
+				kind = KindMethod
+			}
+		default:
+			continue
+		}
+		// Methods aren't in any scope.
+		if kind != KindMethod && obj.Parent() != pkg.Types.Scope() {
+			continue
+		}
+		add(obj.Pos(), ManifestIdent{Orig: obj.Name(), New: ident.Name, Kind: kind, Stub: stubsByName[ident]})
+	}
+
+	for alias, obj := range internalTypes {
+		add(obj.Pos(), ManifestIdent{
+			Orig: obj.Pkg().Name() + "." + obj.Name(),
+			New:  alias,
+			Kind: KindInternalType,
+			Pkg:  obj.Pkg().Path(),
+		})
+	}
+
+	sort.Slice(idents, func(i, j int) bool {
+		if idents[i].pos != idents[j].pos {
+			return idents[i].pos < idents[j].pos
+		}
+		return idents[i].ident.New < idents[j].ident.New
+	})
+	m := &Manifest{
+		Path:          pkg.PkgPath,
+		Name:          pkg.Name,
+		RelocatedPath: RelocatedPath(pkg),
+		RelocatedName: RelocatedName(pkg),
+		Idents:        make([]ManifestIdent, len(idents)),
+	}
+	for i, ident := range idents {
+		m.Idents[i] = ident.ident
+	}
+	return m
+}
+
+// Renames returns the names in m that rewriting introduced, mapped to what
+// they stand for in the original source.
+func (m *Manifest) Renames() Renames {
+	renames := Renames{}
+	for _, ident := range m.Idents {
+		switch {
+		case ident.Kind == KindStub || ident.Kind == KindStubInit:
+			renames[ident.New] = ident.Func
+		// Synthetic names are all "_" in the original, or nothing; Main is
+		// a plausible name in any other package.
+		case ident.Kind == KindArg || ident.Kind == KindReceiver || ident.New == MainFuncName:
+		case ident.New != ident.Orig:
+			renames[ident.New] = ident.Orig
+		}
+	}
+	return renames
+}
@@ -0,0 +1,85 @@
+package gotreload
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// reservedPrefixes are the prefixes of the names rewriting introduces. Names
+// in the original source mustn't use them, so that they can't collide.
+var reservedPrefixes = []string{exportPrefix, stubPrefix, stubInitPrefix, utypePrefix, importPrefix, instancePrefix, syntheticArgPrefix, syntheticReceiver}
+
+// checkReservedNames returns an error listing the names declared in pkg that
+// use one of reservedPrefixes.
+func checkReservedNames(pkg *packages.Package) error {
+	var idents []*ast.Ident
+	for ident := range pkg.TypesInfo.Defs {
+		for _, prefix := range reservedPrefixes {
+			if strings.HasPrefix(ident.Name, prefix) {
+				idents = append(idents, ident)
+				break
+			}
+		}
+	}
+	if len(idents) == 0 {
+		return nil
+	}
+	sort.Slice(idents, func(i, j int) bool { return idents[i].Pos() < idents[j].Pos() })
+	var uses []string
+	for _, ident := range idents {
+		uses = append(uses, fmt.Sprintf("%s: %s", pkg.Fset.Position(ident.Pos()), ident.Name))
+	}
+	return fmt.Errorf("Package %s declares names that got-reload reserves for its rewriting (those starting with %s); rename them:\n\t%s",
+		pkg.PkgPath, strings.Join(reservedPrefixes, ", "), strings.Join(uses, "\n\t"))
+}
+
+// mangle joins parts, which are identifiers, into a single identifier,
+// unambiguously: each "_" in a part becomes "_0", and the parts are joined
+// with "_". Since no identifier starts with a digit, a "_" followed by "0" is
+// always an escaped one. So T.m becomes "T_m", and T_m becomes "T_0m".
+func mangle(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = strings.ReplaceAll(part, "_", "_0")
+	}
+	return strings.Join(escaped, "_")
+}
+
+// stubName returns the name of the stub variable for funcDecl: stubPrefix,
+// then the function's original name, mangled, after its receiver's type name
+// for a method.
+func stubName(pkg *packages.Package, funcDecl *ast.FuncDecl) string {
+	obj, ok := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func)
+	if !ok {
+		return stubPrefix + mangle(funcDecl.Name.Name)
+	}
+	recv := obj.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return stubPrefix + mangle(obj.Name())
+	}
+	recvType := recv.Type()
+	if ptr, ok := recvType.(*types.Pointer); ok {
+		recvType = ptr.Elem()
+	}
+	named, ok := recvType.(*types.Named)
+	if !ok {
+		return stubPrefix + mangle(obj.Name())
+	}
+	return stubPrefix + mangle(named.Obj().Name(), obj.Name())
+}
+
+// internalTypeAlias returns the name of the non-internal alias for obj, a
+// type from an internal package: its package's name and its own, and a hash
+// of its package's import path, which tells apart packages with the same
+// name.
+func internalTypeAlias(obj *types.TypeName) string {
+	h := fnv.New32a()
+	h.Write([]byte(obj.Pkg().Path()))
+	return utypePrefix + "internal_" + mangle(obj.Pkg().Name(), obj.Name(), fmt.Sprintf("h%08x", h.Sum32()))
+}
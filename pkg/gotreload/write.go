@@ -0,0 +1,171 @@
+package gotreload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// RegistrationFileName returns the name of the file that registers pkg's
+// symbols, or with test set, the symbols declared in its _test.go files.
+func RegistrationFileName(pkg *packages.Package, test bool) string {
+	switch {
+	case !test:
+		return "grl_register.go"
+	case strings.HasSuffix(pkg.Name, "_test"):
+		// An external test package shares its directory with the package it
+		// tests.
+		return "grl_register_x_test.go"
+	default:
+		return "grl_register_test.go"
+	}
+}
+
+// Output records what WritePkg did under r.OutputDir, so that it can be done
+// again without filtering.
+type Output struct {
+	// The files written, by path relative to r.OutputDir, with their
+	// contents.
+	Files map[string][]byte
+	// The files removed, relative to r.OutputDir.
+	Removed []string
+}
+
+func (o *Output) write(outputDir, path string, byts []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Error creating %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, byts, 0644); err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(outputDir, path); err == nil {
+		o.Files[rel] = byts
+	}
+	return nil
+}
+
+// WritePkg writes pkg's rewritten source files, its registration files, and
+// its Manifest, under r.OutputDir. Call it after Rewrite with ModeRewrite and genContent
+// set. It returns what it did.
+func (r *Rewriter) WritePkg(pkg *packages.Package) (*Output, error) {
+	out := &Output{Files: map[string][]byte{}}
+	// Is this even possible?
+	if len(pkg.Syntax) == 0 {
+		return out, nil
+	}
+
+	var newDir string
+	// Write new source files for this package, based on the rewritten syntax
+	// tree generated by rewritePkg.
+	for _, file := range pkg.Syntax {
+		// log.Printf("Writing filtered version of %s", targetFileName)
+		sourceFileName := pkg.Fset.Position(file.Pos()).Filename
+		outputFilePath := r.OutputPath(pkg, sourceFileName)
+		newDir = filepath.Dir(outputFilePath)
+		b, err := formatFile(pkg.Fset, file)
+		if err != nil {
+			return nil, fmt.Errorf("Error formatting filtered version of %s: %w", sourceFileName, err)
+		}
+		err = out.write(r.OutputDir, outputFilePath, b)
+		if err != nil {
+			return nil, fmt.Errorf("Error writing filtered version of %s to %s: %w", sourceFileName, outputFilePath, err)
+		}
+		// log.Printf("Wrote %s", outputFilePath)
+	}
+
+	if info := r.Info[pkg]; info != nil {
+		for name, registrations := range map[string][]byte{
+			RegistrationFileName(pkg, false): info.Registrations,
+			RegistrationFileName(pkg, true):  info.TestRegistrations,
+		} {
+			if registrations == nil {
+				continue
+			}
+			outputFilePath := filepath.Join(newDir, name)
+			if err := out.write(r.OutputDir, outputFilePath, registrations); err != nil {
+				return nil, fmt.Errorf("Error writing %s: %w", outputFilePath, err)
+			}
+			// log.Printf("Wrote %s", outputFilePath)
+		}
+		if info.Manifest != nil {
+			byts, err := json.MarshalIndent(info.Manifest, "", "  ")
+			if err != nil {
+				return nil, fmt.Errorf("Error encoding manifest of %s: %w", pkg.PkgPath, err)
+			}
+			outputFilePath := filepath.Join(newDir, ManifestFileName(pkg))
+			if err := out.write(r.OutputDir, outputFilePath, append(byts, '\n')); err != nil {
+				return nil, fmt.Errorf("Error writing %s: %w", outputFilePath, err)
+			}
+		}
+	}
+
+	if pkg.Name == "main" {
+		if err := r.relocateMain(pkg, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// formatFile formats file like FormatNode, with //line directives that map
+// it back to the original source: each line of the old function bodies moved
+// into init closures to where it was, and the code generated for each stubbed
+// function to its declaration. So panics, stack traces, runtime.Caller, log
+// lines and the like point at the original files, not at the work directory.
+func formatFile(fset *token.FileSet, file *ast.File) ([]byte, error) {
+	b := &bytes.Buffer{}
+	config := printer.Config{Mode: printer.UseSpaces | printer.TabIndent | printer.SourcePos, Tabwidth: 8}
+	if err := config.Fprint(b, fset, file); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// relocateMain finishes moving a filtered package main to its MainPackageName
+// subdirectory: it removes the copies of the original source files, writes a
+// main that calls the relocated Main, and copies any embedded files so that
+// the relocated //go:embed patterns still match. It records what it did in
+// out.
+func (r *Rewriter) relocateMain(pkg *packages.Package, out *Output) error {
+	var mainDir string
+	for _, file := range pkg.GoFiles {
+		copied := filepath.Join(r.OutputDir, strings.TrimPrefix(file, r.Pwd+"/"))
+		mainDir = filepath.Dir(copied)
+		if err := os.Remove(copied); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Error removing %s: %w", copied, err)
+		}
+		out.Removed = append(out.Removed, strings.TrimPrefix(file, r.Pwd+"/"))
+	}
+	stubPath := filepath.Join(mainDir, "grl_main.go")
+	if err := out.write(r.OutputDir, stubPath, MainStub(pkg)); err != nil {
+		return fmt.Errorf("Error writing %s: %w", stubPath, err)
+	}
+
+	srcDir := filepath.Dir(pkg.GoFiles[0])
+	relocatedDir := filepath.Join(mainDir, MainPackageName)
+	for _, file := range pkg.EmbedFiles {
+		rel, err := filepath.Rel(srcDir, file)
+		if err != nil {
+			return fmt.Errorf("Error relocating embedded file %s: %w", file, err)
+		}
+		dest := filepath.Join(relocatedDir, rel)
+		byts, err := os.ReadFile(file)
+		if err == nil {
+			err = out.write(r.OutputDir, dest, byts)
+		}
+		if err != nil {
+			return fmt.Errorf("Error copying embedded file %s to %s: %w", file, dest, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package reloader
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/got-reload/got-reload/pkg/gotreload"
+	"golang.org/x/tools/go/packages"
+	goimports "golang.org/x/tools/imports"
+)
+
+// Import path => the stub variables of the methods that were added by
+// reloading, which reloaded code calls via their stubs, since the program's
+// types don't have them.
+var addedMethods = map[string]map[string]bool{}
+
+// defineAdded defines the stub variables of the functions and methods among
+// stubVars, in pkg, that the program wasn't built with, so that their new
+// definitions can be assigned to them like any others, and, for functions,
+// registers their names too, to call them, so that reloaded code can. It
+// returns the stub variables it defined. The generic ones are left alone,
+// since they can't be added.
+func defineAdded(newR *gotreload.Rewriter, pkg *packages.Package, stubVars []string) map[string]bool {
+	pkgPath := pkg.PkgPath
+	key := registrationKey(pkg)
+	defined := map[string]bool{}
+	for _, stubVar := range stubVars {
+		if _, ok := RegisteredSymbols[key][stubVar]; ok || newR.IsGeneric(pkgPath, stubVar) {
+			continue
+		}
+
+		name, method, err := newR.StubbedFunc(pkgPath, stubVar)
+		if err != nil {
+			log.Printf("Cannot add %s: %v", stubVar, err)
+			continue
+		}
+		_, funcLit := newR.FuncNode(pkgPath, stubVar)
+		funcType, _, err := gotreload.FormatNode(pkg.Fset, funcLit.Type)
+		if err != nil {
+			log.Printf("Error getting the type of %s:%s: %v", pkgPath, stubVar, err)
+			continue
+		}
+		file := gotreload.FileFromPos(pkg, funcLit)
+		fnType, err := evalType(funcType, fileImports(pkg, file), pkg.Fset.Position(file.Pos()).Filename)
+		if err != nil {
+			log.Printf("Cannot add %s: %v", stubVar, err)
+			continue
+		}
+
+		stub := reflect.New(fnType).Elem()
+		register(key, stubVar, stub)
+		if method {
+			if addedMethods[pkgPath] == nil {
+				addedMethods[pkgPath] = map[string]bool{}
+			}
+			addedMethods[pkgPath][stubVar] = true
+		} else {
+			register(key, name, reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
+				if fnType.IsVariadic() {
+					return stub.CallSlice(args)
+				}
+				return stub.Call(args)
+			}))
+		}
+		log.Printf("Added %s", stubVar)
+		defined[stubVar] = true
+	}
+	return defined
+}
+
+// evalType returns the type that typeExpr, a Go type expression in code that
+// imports importsList, as filename does, stands for.
+func evalType(typeExpr string, importsList []string, filename string) (reflect.Type, error) {
+	program := fmt.Sprintf(`package main
+import (
+	%s
+)
+var GRLinst %s
+func main() {}`, strings.Join(importsList, "\n"), typeExpr)
+
+	b, err := goimports.Process(filename, []byte(program), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to 'goimports' the type: %w\n%s", err, program)
+	}
+	program = string(b)
+
+	i, err := getInterp()
+	if err != nil {
+		return nil, err
+	}
+	var v reflect.Value
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Eval panicked: %v", r)
+			}
+		}()
+		if _, err = i.Eval(program); err != nil {
+			return
+		}
+		v, err = i.Eval("GRLinst")
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("%w\n%s", err, program)
+	}
+	if !v.IsValid() {
+		return nil, fmt.Errorf("No type found\n%s", program)
+	}
+	return v.Type(), nil
+}
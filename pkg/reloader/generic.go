@@ -0,0 +1,255 @@
+package reloader
+
+import (
+	"fmt"
+	"go/token"
+	"reflect"
+	"strings"
+
+	"github.com/got-reload/got-reload/pkg/gotreload"
+	"github.com/got-reload/got-reload/pkg/reloader/generic"
+	"github.com/traefik/yaegi/interp"
+	"golang.org/x/tools/go/packages"
+	goimports "golang.org/x/tools/imports"
+)
+
+// The package that instantiated generic types are registered in, for
+// instantiations of generic functions to name them.
+const instPkgName = "grl_inst"
+
+// reloadGeneric reloads stubVar, the stub of a generic function or a method
+// of a generic type in pkg, given its new definition, as returned by
+// gotreload.GenericFuncDef, whether it's a method, and the imports of
+// filename, the file it's in. Each of the function's instantiations is
+// evaluated in an interpreter of its own, with the type arguments it's called
+// with; it returns false if any of those the program has called since the
+// function was first reloaded fails.
+func reloadGeneric(pkg *packages.Package, stubVar, def string, method bool, importsList []string, filename string) bool {
+	pkgPath := gotreload.RelocatedPath(pkg)
+	sym, ok := RegisteredSymbols[registrationKey(pkg)][stubVar]
+	if !ok {
+		log.Printf("Cannot find %s.%s among the registered symbols", pkgPath, stubVar)
+		return false
+	}
+	f, ok := sym.Addr().Interface().(*generic.Func)
+	if !ok {
+		log.Printf("%s.%s is a %s, not a generic.Func", pkgPath, stubVar, sym.Type())
+		return false
+	}
+
+	return f.Reload(func(fnType reflect.Type, typeArgs []reflect.Type) any {
+		inst, err := instantiate(pkgPath, def, method, importsList, filename, fnType, typeArgs)
+		if err != nil {
+			log.Printf("Cannot instantiate %s with %v: %v", stubVar, typeArgs, err)
+			return nil
+		}
+		log.Printf("Instantiated %s with %v", stubVar, typeArgs)
+		return inst
+	})
+}
+
+// instantiate evaluates def, the definition of a generic function or method
+// in pkgPath, with typeArgs as its type arguments, and returns the result,
+// which is a fnType.
+func instantiate(pkgPath, def string, method bool, importsList []string, filename string, fnType reflect.Type, typeArgs []reflect.Type) (any, error) {
+	namer := &typeNamer{pkgPath: pkgPath, imports: map[string]string{}}
+	typeArgStrs := make([]string, len(typeArgs))
+	for i, typeArg := range typeArgs {
+		s, err := namer.typeExpr(typeArg)
+		if err != nil {
+			return nil, err
+		}
+		typeArgStrs[i] = s
+	}
+	var recvType string
+	if method {
+		recv := fnType.In(0)
+		if recv.Kind() == reflect.Pointer {
+			recv = recv.Elem()
+		}
+		var err error
+		if recvType, err = namer.typeExpr(recv); err != nil {
+			return nil, err
+		}
+	}
+	for path, name := range namer.imports {
+		importsList = append(importsList, fmt.Sprintf("%s %q", name, path))
+	}
+	if len(namer.insts) > 0 {
+		importsList = append(importsList, fmt.Sprintf("%s %q", instPkgName, instPkgName))
+	}
+
+	program := fmt.Sprintf(`package main
+import (
+	%s
+)
+var GRLinst = %s
+func main() {}`, strings.Join(importsList, "\n"), gotreload.InstantiateFuncDef(def, typeArgStrs, recvType))
+
+	b, err := goimports.Process(filename, []byte(program), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to 'goimports' the instantiation: %w\n%s", err, program)
+	}
+	program = string(b)
+
+	i, err := getInterp()
+	if err != nil {
+		return nil, err
+	}
+	if len(namer.insts) > 0 {
+		syms := map[string]reflect.Value{}
+		for i, t := range namer.insts {
+			syms[instTypeName(i)] = reflect.Zero(reflect.PointerTo(t))
+		}
+		if err := i.Use(interp.Exports{instPkgName + "/" + instPkgName: syms}); err != nil {
+			return nil, err
+		}
+	}
+	var inst reflect.Value
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Eval panicked: %v", r)
+			}
+		}()
+		if _, err = i.Eval(program); err != nil {
+			return
+		}
+		inst, err = i.Eval("GRLinst")
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("%w\n%s", err, program)
+	}
+	if !inst.IsValid() {
+		return nil, fmt.Errorf("No instantiation found\n%s", program)
+	}
+	return inst.Interface(), nil
+}
+
+// A typeNamer names types in code that dot-imports pkgPath.
+type typeNamer struct {
+	pkgPath string
+	// Import path => name, for the packages of the named types.
+	imports map[string]string
+	// Instantiated generic types, which the interpreter can only name once
+	// they're registered, in instPkgName, by instTypeName.
+	insts []reflect.Type
+}
+
+// instTypeName returns the name that the ith of a typeNamer's insts is
+// registered as.
+func instTypeName(i int) string {
+	return fmt.Sprintf("T%d", i)
+}
+
+// typeExpr returns a Go expression for t, adding the packages it needs to
+// n.imports, and the instantiated generic types it needs to n.insts.
+func (n *typeNamer) typeExpr(t reflect.Type) (string, error) {
+	if t.Name() != "" {
+		switch {
+		case strings.Contains(t.Name(), "["):
+			for i, inst := range n.insts {
+				if inst == t {
+					return instPkgName + "." + instTypeName(i), nil
+				}
+			}
+			n.insts = append(n.insts, t)
+			return instPkgName + "." + instTypeName(len(n.insts)-1), nil
+		case t.PkgPath() == "":
+			// Predeclared
+			return t.Name(), nil
+		case t.PkgPath() == n.pkgPath:
+			return t.Name(), nil
+		case !token.IsExported(t.Name()):
+			return "", fmt.Errorf("Unexported types from other packages can't be named: %s", t)
+		}
+		name, ok := n.imports[t.PkgPath()]
+		if !ok {
+			name = fmt.Sprintf("grl_ta%d", len(n.imports))
+			n.imports[t.PkgPath()] = name
+		}
+		return name + "." + t.Name(), nil
+	}
+
+	elem := func() (string, error) { return n.typeExpr(t.Elem()) }
+	switch t.Kind() {
+	case reflect.Pointer:
+		s, err := elem()
+		return "*" + s, err
+	case reflect.Slice:
+		s, err := elem()
+		return "[]" + s, err
+	case reflect.Array:
+		s, err := elem()
+		return fmt.Sprintf("[%d]%s", t.Len(), s), err
+	case reflect.Map:
+		k, err := n.typeExpr(t.Key())
+		if err != nil {
+			return "", err
+		}
+		s, err := elem()
+		return "map[" + k + "]" + s, err
+	case reflect.Chan:
+		s, err := elem()
+		if strings.HasPrefix(s, "<-") {
+			s = "(" + s + ")"
+		}
+		switch t.ChanDir() {
+		case reflect.RecvDir:
+			return "<-chan " + s, err
+		case reflect.SendDir:
+			return "chan<- " + s, err
+		}
+		return "chan " + s, err
+	case reflect.Func:
+		var params, results []string
+		for i := 0; i < t.NumIn(); i++ {
+			s, err := n.typeExpr(t.In(i))
+			if err != nil {
+				return "", err
+			}
+			if t.IsVariadic() && i == t.NumIn()-1 {
+				s = "..." + strings.TrimPrefix(s, "[]")
+			}
+			params = append(params, s)
+		}
+		for i := 0; i < t.NumOut(); i++ {
+			s, err := n.typeExpr(t.Out(i))
+			if err != nil {
+				return "", err
+			}
+			results = append(results, s)
+		}
+		s := "func(" + strings.Join(params, ", ") + ")"
+		switch len(results) {
+		case 0:
+		case 1:
+			s += " " + results[0]
+		default:
+			s += " (" + strings.Join(results, ", ") + ")"
+		}
+		return s, nil
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			s, err := n.typeExpr(field.Type)
+			if err != nil {
+				return "", err
+			}
+			if !field.Anonymous {
+				s = field.Name + " " + s
+			}
+			if field.Tag != "" {
+				s += fmt.Sprintf(" %q", field.Tag)
+			}
+			fields = append(fields, s)
+		}
+		return "struct{" + strings.Join(fields, "; ") + "}", nil
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "interface{}", nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported type argument: %s", t)
+}
@@ -0,0 +1,140 @@
+/*
+Package generic lets got-reload reload generic functions.
+
+A generic function's body can't be kept in a variable, as got-reload does for
+other functions, since variables can't have type parameters. So the filter
+gives each generic function, and each method of a generic type, a Func
+instead, which holds the reloaded versions of the function's instantiations,
+and has the function call them, if there are any, or run its compiled body
+otherwise. The reloader instantiates each one in the interpreter, with the
+type arguments the program used, when it's first called after the function
+is first reloaded, and again when the function is reloaded after that. Until
+the first reload, calls cost only an atomic load.
+*/
+package generic
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// An Instantiator returns a generic function's reloaded body, instantiated
+// with typeArgs, as a fnType, or nil if it can't. For a method, fnType's
+// first parameter is the receiver.
+type Instantiator func(fnType reflect.Type, typeArgs []reflect.Type) any
+
+// A Func holds the reloaded instantiations of a generic function. Its zero
+// value is a function that hasn't been reloaded.
+type Func struct {
+	// Whether the function has been reloaded. Until it has, Get doesn't
+	// look anything up, or record the instantiations the program calls.
+	reloaded atomic.Bool
+
+	mu sync.RWMutex
+	// The function's latest reloaded body, if it's been reloaded, and how
+	// many times it has been.
+	instantiate Instantiator
+	gen         int
+	// Every instantiation the program has called since the first reload,
+	// by the types that Get was given as K: what it should call for it, or
+	// nil if it couldn't be instantiated, and its type, which Get was given
+	// as F.
+	insts   map[reflect.Type]any
+	fnTypes map[reflect.Type]reflect.Type
+}
+
+// Get returns f's reloaded instantiation with the types of K's parameters
+// as type arguments, as an F, or nil if it's still to be reloaded, or
+// couldn't be instantiated. K is a func type with a parameter for each type
+// parameter, in order, so that it's the same type exactly when the type
+// arguments are.
+func Get[F, K any](f *Func) F {
+	if !f.reloaded.Load() {
+		var zero F
+		return zero
+	}
+	key := reflect.TypeOf((*K)(nil)).Elem()
+	f.mu.RLock()
+	inst, ok := f.insts[key]
+	f.mu.RUnlock()
+	if !ok {
+		inst = f.add(key, reflect.TypeOf((*F)(nil)).Elem())
+	}
+	fn, _ := inst.(F)
+	return fn
+}
+
+// add instantiates f's latest body for key, and records it, and fnType,
+// its type. Instantiating runs the interpreter, so it's done without f.mu
+// held, so as not to hold up calls of other instantiations; if f is
+// reloaded meanwhile, it's done again.
+func (f *Func) add(key, fnType reflect.Type) any {
+	for {
+		f.mu.RLock()
+		instantiate, gen := f.instantiate, f.gen
+		f.mu.RUnlock()
+		inst := instantiate(fnType, typeArgs(key))
+
+		f.mu.Lock()
+		if existing, ok := f.insts[key]; ok {
+			f.mu.Unlock()
+			return existing
+		}
+		if f.gen != gen {
+			f.mu.Unlock()
+			continue
+		}
+		if f.insts == nil {
+			f.insts = map[reflect.Type]any{}
+			f.fnTypes = map[reflect.Type]reflect.Type{}
+		}
+		f.insts[key] = inst
+		f.fnTypes[key] = fnType
+		f.mu.Unlock()
+		return inst
+	}
+}
+
+// Reload replaces f's body with the one instantiate instantiates, and
+// instantiates it for every instantiation the program has called since f
+// was first reloaded. Others are instantiated when they're first called.
+// Until it's done, calls get their previous instantiations. It returns
+// false if any of them couldn't be instantiated. It must not be called
+// concurrently.
+func (f *Func) Reload(instantiate Instantiator) bool {
+	f.mu.Lock()
+	f.instantiate = instantiate
+	f.gen++
+	fnTypes := make(map[reflect.Type]reflect.Type, len(f.fnTypes))
+	for key, fnType := range f.fnTypes {
+		fnTypes[key] = fnType
+	}
+	f.mu.Unlock()
+	f.reloaded.Store(true)
+
+	ok := true
+	insts := make(map[reflect.Type]any, len(fnTypes))
+	for key, fnType := range fnTypes {
+		inst := instantiate(fnType, typeArgs(key))
+		ok = ok && inst != nil
+		insts[key] = inst
+	}
+
+	f.mu.Lock()
+	for key, inst := range insts {
+		f.insts[key] = inst
+	}
+	f.mu.Unlock()
+	return ok
+}
+
+// typeArgs returns the type arguments that key, as given to Get, stands
+// for.
+func typeArgs(key reflect.Type) []reflect.Type {
+	args := make([]reflect.Type, key.NumIn())
+	for i := range args {
+		args[i] = key.In(i)
+	}
+	return args
+}
@@ -0,0 +1,89 @@
+package generic
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	var f Func
+	assert.Nil(t, Get[func(int) int, func(int)](&f))
+
+	var calls []reflect.Type
+	ok := f.Reload(func(fnType reflect.Type, typeArgs []reflect.Type) any {
+		calls = append(calls, typeArgs...)
+		if typeArgs[0] != reflect.TypeOf(0) {
+			return nil
+		}
+		return func(i int) int { return i * 2 }
+	})
+	// Nothing was recorded before the first reload.
+	assert.True(t, ok)
+	assert.Empty(t, calls)
+
+	fn := Get[func(int) int, func(int)](&f)
+	if assert.NotNil(t, fn) {
+		assert.Equal(t, 4, fn(2))
+	}
+	assert.Nil(t, Get[func(string) string, func(string)](&f))
+	assert.Equal(t, []reflect.Type{reflect.TypeOf(0), reflect.TypeOf("")}, calls)
+
+	// Reloading again instantiates everything called since.
+	calls = nil
+	ok = f.Reload(func(fnType reflect.Type, typeArgs []reflect.Type) any {
+		calls = append(calls, typeArgs...)
+		return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value { return args }).Interface()
+	})
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []reflect.Type{reflect.TypeOf(0), reflect.TypeOf("")}, calls)
+	assert.Equal(t, "s", Get[func(string) string, func(string)](&f)("s"))
+}
+
+func TestGetUnlocked(t *testing.T) {
+	var f Func
+	started, release := make(chan struct{}), make(chan struct{})
+	f.Reload(func(fnType reflect.Type, typeArgs []reflect.Type) any {
+		switch typeArgs[0] {
+		case reflect.TypeOf(0):
+			close(started)
+			<-release
+		case reflect.TypeOf(0.0):
+			panic("instantiating")
+		}
+		return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value { return args }).Interface()
+	})
+
+	// Instantiating for one type doesn't hold up calls for others.
+	done := make(chan func(int) int)
+	go func() { done <- Get[func(int) int, func(int)](&f) }()
+	<-started
+	assert.Equal(t, "s", Get[func(string) string, func(string)](&f)("s"))
+	close(release)
+	assert.Equal(t, 1, (<-done)(1))
+
+	// Nor does a panic while instantiating.
+	assert.Panics(t, func() { Get[func(float64) float64, func(float64)](&f) })
+	assert.Equal(t, "t", Get[func(string) string, func(string)](&f)("t"))
+}
+
+func BenchmarkGet(b *testing.B) {
+	b.Run("not reloaded", func(b *testing.B) {
+		var f Func
+		for i := 0; i < b.N; i++ {
+			if fn := Get[func(int) int, func(int)](&f); fn != nil {
+				b.Fatal("reloaded")
+			}
+		}
+	})
+	b.Run("reloaded", func(b *testing.B) {
+		var f Func
+		f.Reload(func(reflect.Type, []reflect.Type) any { return func(i int) int { return i } })
+		for i := 0; i < b.N; i++ {
+			if fn := Get[func(int) int, func(int)](&f); fn == nil {
+				b.Fatal("not reloaded")
+			}
+		}
+	})
+}
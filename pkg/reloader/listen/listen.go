@@ -0,0 +1,71 @@
+/*
+Package listen lets a program keep its listening sockets open while got-reload
+rebuilds and restarts it.
+
+When "got-reload run" is given -listen addresses, it opens those listeners
+itself and hands them to each new instance of the program. Use Listen in place
+of net.Listen for those addresses, and connections that arrive during a
+restart wait in the socket's backlog instead of being refused.
+
+Listen has no dependencies on the rest of got-reload, so it is safe to call
+from code that is also built without it.
+*/
+package listen
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Env holds the comma-separated list of addresses whose listeners were
+// passed to this process, in order, starting at file descriptor 3.
+const Env = "GOT_RELOAD_LISTENERS"
+
+var (
+	mux sync.Mutex
+	// Inherited listener files, by address. Kept so that their finalizers
+	// don't close the descriptors out from under later calls to Listen.
+	files = map[string]*os.File{}
+)
+
+// Addresses returns the addresses of the listeners passed to this process.
+func Addresses() []string {
+	list := os.Getenv(Env)
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// Listen is like net.Listen, except that if got-reload is holding a TCP
+// listener open for address, that listener is returned instead. The address
+// must be spelled exactly as it was given to "got-reload run -listen".
+func Listen(network, address string) (net.Listener, error) {
+	if strings.HasPrefix(network, "tcp") {
+		if f := inherited(address); f != nil {
+			// FileListener dups the descriptor, so closing the returned
+			// listener leaves the inherited one open for the next call.
+			return net.FileListener(f)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+func inherited(address string) *os.File {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if f, ok := files[address]; ok {
+		return f
+	}
+	for i, addr := range Addresses() {
+		if addr == address {
+			f := os.NewFile(uintptr(3+i), addr)
+			files[address] = f
+			return f
+		}
+	}
+	return nil
+}
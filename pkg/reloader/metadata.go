@@ -0,0 +1,75 @@
+package reloader
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// MetadataSuffix is appended to the path of an executable built by
+// "got-reload build" to get the path of its metadata file. The file holds a
+// JSON object mapping the GOT_RELOAD_* environment variables to the values
+// "got-reload run" would have set, so that the executable can be started
+// directly.
+const MetadataSuffix = ".got-reload-meta.json"
+
+var (
+	metadataOnce sync.Once
+	metadata     map[string]string
+)
+
+// MetadataPath returns the path of the metadata file for executable.
+func MetadataPath(executable string) string {
+	return executable + MetadataSuffix
+}
+
+// Getenv is like os.Getenv, except that if key isn't set in the environment,
+// it returns the value from the executable's metadata file, if any. Set a
+// variable to override the metadata file, e.g. GOT_RELOAD_START_RELOADER=0
+// to run without reloading.
+func Getenv(key string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	metadataOnce.Do(readMetadata)
+	return metadata[key]
+}
+
+func readMetadata() {
+	executable, err := os.Executable()
+	if err != nil {
+		return
+	}
+	byts, err := os.ReadFile(MetadataPath(executable))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading metadata file: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(byts, &metadata); err != nil {
+		log.Printf("Error parsing metadata file %s: %v", MetadataPath(executable), err)
+	}
+}
+
+// goEnvVars are the go command's settings that "got-reload build" records in
+// the metadata file when the program needs them to load its packages, e.g.
+// GOFLAGS=-mod=vendor and GOPROXY=off for vendored dependencies.
+var goEnvVars = []string{"GOFLAGS", "GOPROXY"}
+
+// goEnviron returns the environment to run the go command in: the process's,
+// plus any of goEnvVars that only the metadata file sets.
+func goEnviron() []string {
+	env := os.Environ()
+	for _, key := range goEnvVars {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if val := Getenv(key); val != "" {
+			env = append(env, key+"="+val)
+		}
+	}
+	return env
+}
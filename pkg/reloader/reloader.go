@@ -8,12 +8,16 @@ package reloader
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"go/ast"
 	lpkg "log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -25,6 +29,7 @@ import (
 	"github.com/traefik/yaegi/stdlib"
 	"github.com/traefik/yaegi/stdlib/unrestricted"
 	"github.com/traefik/yaegi/stdlib/unsafe"
+	"golang.org/x/tools/go/packages"
 	goimports "golang.org/x/tools/imports"
 )
 
@@ -32,8 +37,44 @@ const (
 	PackageListEnv   = "GOT_RELOAD_PKGS"
 	StartReloaderEnv = "GOT_RELOAD_START_RELOADER"
 	SourceDirEnv     = "GOT_RELOAD_SOURCE_DIR"
+	// RestartFileEnv names the file to which the reloader writes the packages
+	// that need to be refiltered and rebuilt, one per line, before exiting
+	// with RestartExitCode. If it's not set, unreloadable changes are just
+	// logged.
+	RestartFileEnv = "GOT_RELOAD_RESTART_FILE"
+	// ExcludeFilesEnv and ExcludeFuncsEnv hold JSON-encoded lists of the
+	// file glob patterns and function regular expressions to leave
+	// unstubbed. They must match what the program was filtered with.
+	ExcludeFilesEnv = "GOT_RELOAD_EXCLUDE_FILES"
+	ExcludeFuncsEnv = "GOT_RELOAD_EXCLUDE_FUNCS"
+	// DebounceEnv is how long to wait after a file changes for more changes
+	// before reloading, as parsed by time.ParseDuration. The default is
+	// 100ms.
+	DebounceEnv = "GOT_RELOAD_DEBOUNCE"
+	// BuildFlagsEnv holds a JSON-encoded list of the flags the program was
+	// built with, e.g. ["-tags=dev", "-race"], so that changed packages are
+	// loaded and type-checked the same way.
+	BuildFlagsEnv = "GOT_RELOAD_BUILD_FLAGS"
+	// TestsEnv is set to "1" when the program is a test binary whose
+	// watched packages were filtered with their _test.go files.
+	TestsEnv = "GOT_RELOAD_TESTS"
+	// WorkDirEnv is the directory the program's filtered code was written
+	// to. After each successful reload, the reloader refilters the changed
+	// package into it, so that it matches the running code.
+	WorkDirEnv = "GOT_RELOAD_WORK_DIR"
+	// SourceRootEnv is the directory that WorkDirEnv is a copy of: the
+	// common ancestor of the local modules whose packages are watched. If
+	// it's not set, it's the root of the module of each changed package.
+	SourceRootEnv = "GOT_RELOAD_SOURCE_ROOT"
 )
 
+const defaultDebounce = 100 * time.Millisecond
+
+// RestartExitCode is the exit status the reloader uses to ask "got-reload
+// run" to rebuild and restart the program. (It's EX_TEMPFAIL from
+// sysexits.h.)
+const RestartExitCode = 75
+
 var (
 	// Use our own logger.
 	log = lpkg.New(os.Stderr, "GRL: ", lpkg.Lshortfile|lpkg.Lmicroseconds)
@@ -46,10 +87,18 @@ var (
 	// disk directories and go package names.
 	PkgsToDirs, DirsToPkgs = watchDirs()
 
+	// The flags the program was built with, from $GOT_RELOAD_BUILD_FLAGS.
+	buildFlags = readBuildFlags()
+
 	RegisteredSymbols = interp.Exports{}
 	mux               sync.Mutex
 	registerRead      bool
 
+	// Guards RegisteredSymbols, which reloading adds to while the program's
+	// goroutines read it, to instantiate generic functions. (mux can't,
+	// since it's held while reloading.)
+	symbolsMux sync.RWMutex
+
 	// A mux for accessing r, the gotreload.Rewriter
 	rMux sync.Mutex
 
@@ -74,12 +123,21 @@ func register(pkgName, ident string, val reflect.Value) {
 	// baseName := path.Base(pkgName)
 	// log.Printf("Register %s.%s as package %s", pkgName, ident, baseName)
 	// pkgName = baseName
+	symbolsMux.Lock()
+	defer symbolsMux.Unlock()
 	if RegisteredSymbols[pkgName] == nil {
 		RegisteredSymbols[pkgName] = map[string]reflect.Value{}
 	}
 	RegisteredSymbols[pkgName][ident] = val
 }
 
+// registrationKey returns the key that pkg's symbols are registered under,
+// as extract generates them.
+func registrationKey(pkg *packages.Package) string {
+	pkgPath := gotreload.RelocatedPath(pkg)
+	return pkgPath + "/" + path.Base(pkgPath)
+}
+
 // RegisterAll invokes Register once for each symbol provided in the symbols
 // map.
 func RegisterAll(symbols interp.Exports) {
@@ -102,14 +160,55 @@ func RegisterAll(symbols interp.Exports) {
 }
 
 func watchPackages() []string {
-	list := os.Getenv(PackageListEnv)
+	list := Getenv(PackageListEnv)
 	return strings.Split(list, ",")
 }
 
+func readBuildFlags() []string {
+	val := Getenv(BuildFlagsEnv)
+	if val == "" {
+		return nil
+	}
+	var flags []string
+	if err := json.Unmarshal([]byte(val), &flags); err != nil {
+		log.Printf("Error parsing $%s; ignoring it: %v", BuildFlagsEnv, err)
+		return nil
+	}
+	return flags
+}
+
+// buildTags returns the tags given to -tags in flags, if any.
+func buildTags(flags []string) []string {
+	var tags []string
+	for i, flag := range flags {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(flag, "-"), "=")
+		if name != "tags" && name != "-tags" {
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(flags) {
+				break
+			}
+			value = flags[i+1]
+		}
+		// -tags takes a comma-separated list; older versions of Go used
+		// spaces.
+		tags = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	return tags
+}
+
+// watchDirs finds the directories of the watched packages. They're listed
+// by import path, rather than as "./...", since they can be in any of the
+// modules of a workspace, or in modules replaced by local directories.
 func watchDirs() (pkgToDir map[string]string, dirToPkg map[string]string) {
 	pkgToDir, dirToPkg = make(map[string]string), make(map[string]string)
-	cmd := exec.CommandContext(context.TODO(), "go", "list", "-f", "{{.ImportPath}} {{.Dir}}", "./...")
-	cmd.Dir = os.Getenv(SourceDirEnv)
+	args := append([]string{"list", "-e"}, buildFlags...)
+	args = append(args, "-f", "{{.ImportPath}} {{.Dir}}")
+	args = append(args, watchPackages()...)
+	cmd := exec.CommandContext(context.TODO(), "go", args...)
+	cmd.Dir = Getenv(SourceDirEnv)
+	cmd.Env = goEnviron()
 	if cmd.Dir != "" {
 		log.Printf("Running go list from %s", cmd.Dir)
 	}
@@ -117,18 +216,13 @@ func watchDirs() (pkgToDir map[string]string, dirToPkg map[string]string) {
 	if err != nil {
 		return
 	}
-	lines := strings.Split(string(out), "\n")
-	for _, pkg := range watchPackages() {
-	innerLoop:
-		for _, line := range lines {
-			if !strings.HasPrefix(line, pkg) {
-				continue innerLoop
-			}
-			dir := strings.Fields(line)[1]
-			pkgToDir[pkg] = dir
-			dirToPkg[dir] = pkg
-			break innerLoop
+	for _, line := range strings.Split(string(out), "\n") {
+		pkg, dir, ok := strings.Cut(line, " ")
+		if !ok || dir == "" {
+			continue
 		}
+		pkgToDir[pkg] = dir
+		dirToPkg[dir] = pkg
 	}
 	return
 }
@@ -136,9 +230,11 @@ func watchDirs() (pkgToDir map[string]string, dirToPkg map[string]string) {
 // StartWatching returns a channel and a new gotreload.Rewriter. The channel
 // emits a series of filenames (absolute paths) that've changed.
 func StartWatching(list []string) (<-chan string, chan struct{}, *gotreload.Rewriter, error) {
-	r := gotreload.NewRewriter()
-	r.Config.Dir = os.Getenv(SourceDirEnv)
-	err := r.Load(list...)
+	r, err := newRewriter()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = r.Load(list...)
 	if err != nil {
 		log.Fatalf("Error parsing packages: %v", err)
 	}
@@ -200,7 +296,45 @@ func Start() {
 		return
 	}
 
-	go rlLoop(r, changedCh, exitCh, 100*time.Millisecond)
+	dur := defaultDebounce
+	if val := Getenv(DebounceEnv); val != "" {
+		dur, err = time.ParseDuration(val)
+		if err != nil {
+			log.Printf("Error parsing $%s, using %v: %v", DebounceEnv, defaultDebounce, err)
+			dur = defaultDebounce
+		}
+	}
+
+	go rlLoop(r, changedCh, exitCh, dur)
+}
+
+// newRewriter returns a gotreload.Rewriter configured from the environment
+// the same way the program's packages were filtered.
+func newRewriter() (*gotreload.Rewriter, error) {
+	r := gotreload.NewRewriter()
+	r.Config.Dir = Getenv(SourceDirEnv)
+	r.Config.Env = goEnviron()
+	r.Config.BuildFlags = buildFlags
+	r.Config.Tests = Getenv(TestsEnv) == "1"
+	if val := Getenv(ExcludeFilesEnv); val != "" {
+		if err := json.Unmarshal([]byte(val), &r.ExcludeFiles); err != nil {
+			return nil, fmt.Errorf("Error parsing $%s: %w", ExcludeFilesEnv, err)
+		}
+	}
+	if val := Getenv(ExcludeFuncsEnv); val != "" {
+		var exprs []string
+		if err := json.Unmarshal([]byte(val), &exprs); err != nil {
+			return nil, fmt.Errorf("Error parsing $%s: %w", ExcludeFuncsEnv, err)
+		}
+		for _, expr := range exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing $%s: %w", ExcludeFuncsEnv, err)
+			}
+			r.ExcludeFuncs = append(r.ExcludeFuncs, re)
+		}
+	}
+	return r, nil
 }
 
 func rlLoop(r *gotreload.Rewriter, changedCh <-chan string, exitCh chan struct{}, dur time.Duration) {
@@ -261,14 +395,23 @@ func rlLoop(r *gotreload.Rewriter, changedCh <-chan string, exitCh chan struct{}
 }
 
 func processChanges(r *gotreload.Rewriter, changed map[string]bool) error {
+	var restartPkgs []string
+	defer func() {
+		if len(restartPkgs) > 0 {
+			restart(restartPkgs)
+		}
+	}()
+
 	for updated := range changed {
 		log.Printf("Reparsing package containing %s", updated)
-		newR := gotreload.NewRewriter()
-		newR.Config.Dir = os.Getenv(SourceDirEnv)
+		newR, err := newRewriter()
+		if err != nil {
+			return err
+		}
 
 		// Load with file=<foo> loads the package that contains the
 		// given file.
-		err := newR.Load("file=" + updated)
+		err = newR.Load("file=" + updated)
 		if err != nil {
 			log.Fatalf("Error parsing package containing file %s: %v", updated, err)
 		}
@@ -286,7 +429,10 @@ func processChanges(r *gotreload.Rewriter, changed map[string]bool) error {
 			log.Fatalf("Error reloading package for %s: %v", updated, err)
 		}
 
-		err = processSingleChange(r, newR, changed)
+		needsRestart, err := processSingleChange(r, newR, changed)
+		if needsRestart {
+			restartPkgs = append(restartPkgs, newR.Pkgs[0].PkgPath)
+		}
 		if err != nil {
 			return err
 		}
@@ -294,7 +440,22 @@ func processChanges(r *gotreload.Rewriter, changed map[string]bool) error {
 	return nil
 }
 
-func processSingleChange(r, newR *gotreload.Rewriter, changed map[string]bool) error {
+// restart asks "got-reload run" to refilter pkgs, rebuild, and restart the
+// program, by recording pkgs in the restart file and exiting.
+func restart(pkgs []string) {
+	log.Printf("Restarting to pick up changes in %v", pkgs)
+	err := os.WriteFile(Getenv(RestartFileEnv), []byte(strings.Join(pkgs, "\n")+"\n"), 0644)
+	if err != nil {
+		log.Printf("Error writing restart file; not restarting: %v", err)
+		return
+	}
+	os.Exit(RestartExitCode)
+}
+
+// processSingleChange reloads the changed functions in newR's package. It
+// returns true without reloading anything if the package changed in a way
+// that needs a rebuild, and a restart has been requested via RestartFileEnv.
+func processSingleChange(r, newR *gotreload.Rewriter, changed map[string]bool) (bool, error) {
 	rMux.Lock()
 	defer rMux.Unlock()
 
@@ -302,6 +463,21 @@ func processSingleChange(r, newR *gotreload.Rewriter, changed map[string]bool) e
 	// log.Printf("Looking for pkg %s", newPkg.PkgPath)
 	pkgPath := newR.Pkgs[0].PkgPath
 
+	if reasons := r.Unreloadable(newR, pkgPath); len(reasons) > 0 {
+		for _, reason := range reasons {
+			log.Printf("Cannot reload %s: %s", pkgPath, reason)
+		}
+		if Getenv(RestartFileEnv) != "" {
+			for name := range changed {
+				if gotreload.FileFromName(newPkg, name) != nil {
+					delete(changed, name)
+				}
+			}
+			return true, nil
+		}
+		log.Printf("Restart the program to pick up these changes; reloading what can be reloaded")
+	}
+
 	log.Printf("Looking for updated functions in %s", pkgPath)
 
 	// Look at all stubbed functions, and build a map of only those in files that
@@ -324,7 +500,14 @@ func processSingleChange(r, newR *gotreload.Rewriter, changed map[string]bool) e
 	}
 	sort.Strings(possiblyChangedStubVars)
 
+	// Define the functions and methods that the program wasn't built with,
+	// and have reloaded code call the methods via their stubs.
+	added := defineAdded(newR, newPkg, possiblyChangedStubVars)
+	newR.CallMethodStubs(pkgPath, addedMethods[pkgPath])
+
 	updatedFound := false
+	// Whether anything that changed failed to reload.
+	failed := false
 	// Look at all the functions that might've changed, because of being in one
 	// of the files that changed.
 	for _, stubVar := range possiblyChangedStubVars {
@@ -336,17 +519,21 @@ func processSingleChange(r, newR *gotreload.Rewriter, changed map[string]bool) e
 		newDefStr, _, err := gotreload.FormatNode(newPkg.Fset, funcLit)
 		if err != nil {
 			log.Printf("Error getting new function definition of %s:%s: %v", pkgPath, stubVar, err)
+			failed = true
 			continue
 		}
 
 		status := "is new"
-		if hasPragma(newDefStr, "ForceReload") {
+		if added[stubVar] {
+			status = "was added"
+		} else if hasPragma(newDefStr, "ForceReload") {
 			status = "forced reload"
 		} else {
 			// Get a string version of the old function definition
 			origDefStr, err := r.FuncDef(pkgPath, stubVar)
 			if err != nil {
 				log.Printf("Error getting function definition of %s:%s: %v", pkgPath, stubVar, err)
+				failed = true
 				continue
 			}
 
@@ -365,22 +552,27 @@ func processSingleChange(r, newR *gotreload.Rewriter, changed map[string]bool) e
 
 		log.Printf("%s %s", stubVar, status)
 
-		// Get the named imports (if any) from the changed file
 		changedFile := gotreload.FileFromPos(newPkg, funcLit)
-		importsList := []string{
-			fmt.Sprintf(". %q", newR.Pkgs[0].PkgPath),
-		}
-		for _, imp := range changedFile.Imports {
-			impName := newPkg.TypesInfo.PkgNameOf(imp).Name()
-
-			// Note that imp.Path.Value includes the surrounding
-			// double-quotes of the import.
-			importsList = append(importsList,
-				fmt.Sprintf("%s %s", impName, imp.Path.Value))
-		}
+		importsList := fileImports(newPkg, changedFile)
 		imports := strings.Join(importsList, "\n")
 		// log.Printf("Imports:\n%s", imports)
 
+		updatedFilename := newPkg.Fset.Position(changedFile.Pos()).Filename
+		if newR.IsGeneric(pkgPath, stubVar) {
+			genericDef, method, err := newR.GenericFuncDef(pkgPath, stubVar)
+			if err != nil {
+				log.Printf("Error getting function definition of %s:%s: %v", pkgPath, stubVar, err)
+				failed = true
+				continue
+			}
+			if !reloadGeneric(newPkg, stubVar, genericDef, method, importsList, updatedFilename) {
+				failed = true
+				continue
+			}
+			log.Printf("Reloaded %s", stubVar)
+			continue
+		}
+
 		mainFunc := fmt.Sprintf(`package main
 import (
 	%s
@@ -392,11 +584,11 @@ func main() {
 		// Run "goimports" on the generated main() function.
 		//
 		// TODO: Could probably adapt astutil.UsesImport for this.
-		updatedFilename := newPkg.Fset.Position(changedFile.Pos()).Filename
 		mfBytes, err := goimports.Process(updatedFilename, []byte(mainFunc), nil)
 		if err != nil {
 			log.Printf("failed to 'goimports' source for %s: %v", stubVar, err)
 			log.Printf("Main func: %s", mainFunc)
+			failed = true
 			continue
 		}
 		mainFunc = string(mfBytes)
@@ -410,7 +602,7 @@ func main() {
 		i, err := getInterp()
 		if err != nil {
 			log.Printf("Error getting a new interp: %v", err)
-			return err
+			return false, err
 		}
 
 		var r any
@@ -430,6 +622,7 @@ func main() {
 		}()
 
 		if panicked {
+			failed = true
 			log.Printf("ERROR: Interpreter panicked: %v", err)
 			errStr := fmt.Sprintf("%v", r)
 			var line int
@@ -449,6 +642,7 @@ func main() {
 				}
 			}
 		} else {
+			failed = true
 			errStr := err.Error()
 			log.Printf("Eval error: %s", errStr)
 			var line int
@@ -482,9 +676,71 @@ func main() {
 	}
 	r.NewFunc[pkgPath] = newR.NewFunc[pkgPath]
 
+	if failed {
+		log.Printf("Not updating the work dir for %s, since not everything reloaded", pkgPath)
+	} else if err := syncWorkDir(pkgPath); err != nil {
+		log.Printf("Error updating the work dir for %s: %v", pkgPath, err)
+	}
+
+	return false, nil
+}
+
+// syncWorkDir refilters pkgPath into the work dir, if there is one, so that
+// the filtered code there matches the running code.
+func syncWorkDir(pkgPath string) error {
+	workDir := Getenv(WorkDirEnv)
+	if workDir == "" {
+		return nil
+	}
+	r, err := newRewriter()
+	if err != nil {
+		return err
+	}
+	if err := r.Load(pkgPath); err != nil {
+		return err
+	}
+	if len(r.Pkgs) == 0 || r.Pkgs[0].Module == nil {
+		return fmt.Errorf("Cannot find the module containing %s", pkgPath)
+	}
+	r.OutputDir = workDir
+	r.Pwd = Getenv(SourceRootEnv)
+	if r.Pwd == "" {
+		r.Pwd = r.Pkgs[0].Module.Dir
+	}
+	if err := r.Rewrite(gotreload.ModeRewrite, true); err != nil {
+		return err
+	}
+	for _, pkg := range r.Pkgs {
+		if _, err := r.WritePkg(pkg); err != nil {
+			return err
+		}
+	}
+	log.Printf("Updated %s in %s", pkgPath, workDir)
 	return nil
 }
 
+// fileImports returns the imports that code evaluated on behalf of file, in
+// pkg, needs: pkg itself, dot-imported, and file's own imports (if any), named.
+func fileImports(pkg *packages.Package, file *ast.File) []string {
+	importsList := []string{
+		fmt.Sprintf(". %q", gotreload.RelocatedPath(pkg)),
+	}
+	for _, imp := range file.Imports {
+		pkgName := pkg.TypesInfo.PkgNameOf(imp)
+		if pkgName == nil {
+			// Added by rewriting, and not used by the original code.
+			continue
+		}
+		impName := pkgName.Name()
+
+		// Note that imp.Path.Value includes the surrounding
+		// double-quotes of the import.
+		importsList = append(importsList,
+			fmt.Sprintf("%s %s", impName, imp.Path.Value))
+	}
+	return importsList
+}
+
 func hasPragma(s, pragma string) bool {
 	return strings.Contains(s, fmt.Sprintf("pragma.%s()\n", pragma))
 }
@@ -492,6 +748,10 @@ func hasPragma(s, pragma string) bool {
 func getInterp() (*interp.Interpreter, error) {
 	i := interp.New(interp.Options{
 		GoPath: os.Getenv("GOPATH"),
+		// Without this, os.Getenv in reloaded code sees an empty
+		// environment.
+		Env:       os.Environ(),
+		BuildTags: buildTags(buildFlags),
 	})
 	err := i.Use(stdlib.Symbols)
 	if err != nil {
@@ -510,7 +770,9 @@ func getInterp() (*interp.Interpreter, error) {
 
 	// i.Use(interp.Symbols)
 	// log.Printf("Registered symbols: %v", RegisteredSymbols)
+	symbolsMux.RLock()
 	err = i.Use(RegisteredSymbols)
+	symbolsMux.RUnlock()
 	if err != nil {
 		return nil, fmt.Errorf("Error Using RegisteredSymbols")
 	}
@@ -4,13 +4,11 @@
 package start
 
 import (
-	"os"
-
 	"github.com/got-reload/got-reload/pkg/reloader"
 )
 
 func init() {
-	if val, ok := os.LookupEnv(reloader.StartReloaderEnv); ok && val == "1" {
+	if reloader.Getenv(reloader.StartReloaderEnv) == "1" {
 		reloader.Start()
 	}
 }
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package workdir
+
+import "os"
+
+// processExists reports whether there's a process with the given pid. Only
+// Kill can be sent to processes here, so it relies on os.FindProcess, which
+// fails for processes that don't exist on Windows, and otherwise assumes
+// that they do, so that live sessions' directories are never removed.
+func processExists(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
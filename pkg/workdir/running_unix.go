@@ -0,0 +1,20 @@
+//go:build unix
+
+package workdir
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processExists reports whether there's a process with the given pid.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 checks that the process exists without disturbing it.
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
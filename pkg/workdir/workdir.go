@@ -0,0 +1,228 @@
+/*
+Package workdir manages the work directories that got-reload filters code
+into.
+
+Each one holds a marker file, MarkerDir/MarkerFile, recording the session
+that uses it: the module it's a copy of, and the got-reload process, so that
+got-reload can tell its own directories from anyone else's before clearing or
+removing them, and tell the sessions that are still running from the ones
+that were left behind.
+*/
+package workdir
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// MarkerDir is the directory in a work directory for got-reload's own
+	// files, and MarkerFile is the marker in it.
+	MarkerDir  = ".got-reload"
+	MarkerFile = "session.json"
+
+	// TempPattern is the os.MkdirTemp pattern for temporary work
+	// directories, which are created in os.TempDir().
+	TempPattern = "got-reload-*"
+)
+
+// Session is the contents of a work directory's marker.
+type Session struct {
+	// The directory; not stored in the marker.
+	Dir string `json:"-"`
+	// The root of the module that the directory holds a copy of.
+	Module string `json:"module"`
+	// The got-reload process using it, and the host it runs on.
+	PID  int    `json:"pid"`
+	Host string `json:"host"`
+	// When the session started.
+	Created time.Time `json:"created"`
+	// Whether got-reload created the directory as a temporary one, to
+	// remove when it's done.
+	Temp bool `json:"temp"`
+}
+
+// Create creates a temporary work directory for a copy of module, and marks
+// it as ours.
+func Create(module string) (*Session, error) {
+	dir, err := os.MkdirTemp("", TempPattern)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create work directory: %w", err)
+	}
+	s := newSession(dir, module, true)
+	if err := s.write(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Prepare readies dir for use as the work directory for a copy of module,
+// and marks it as ours. It creates dir if it doesn't exist, and clears it if
+// an earlier session used it. It refuses to touch a directory that has
+// anything in it but isn't marked, or whose session is still running.
+func Prepare(dir, module string) (*Session, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("Unable to create work directory: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("Unable to read work directory: %w", err)
+	case len(entries) > 0:
+		old, err := Read(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("Work directory %s isn't empty, and got-reload didn't create it; empty it, or use another directory", dir)
+		} else if err != nil {
+			return nil, err
+		}
+		if old.Running() && old.PID != os.Getpid() {
+			return nil, fmt.Errorf("Work directory %s is in use by got-reload (pid %d)", dir, old.PID)
+		}
+		if err := clearDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	s := newSession(dir, module, false)
+	if err := s.write(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newSession(dir, module string, temp bool) *Session {
+	host, _ := os.Hostname()
+	return &Session{
+		Dir:     dir,
+		Module:  module,
+		PID:     os.Getpid(),
+		Host:    host,
+		Created: time.Now(),
+		Temp:    temp,
+	}
+}
+
+// clearDir removes everything from dir but its marker, which goes last, so
+// that an interrupted clear leaves dir marked.
+func clearDir(dir string) error {
+	for _, d := range []string{dir, filepath.Join(dir, MarkerDir)} {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			return fmt.Errorf("Unable to clear work directory: %w", err)
+		}
+		for _, entry := range entries {
+			if d == dir && entry.Name() == MarkerDir || d != dir && entry.Name() == MarkerFile {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(d, entry.Name())); err != nil {
+				return fmt.Errorf("Unable to clear work directory: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func markerPath(dir string) string {
+	return filepath.Join(dir, MarkerDir, MarkerFile)
+}
+
+func (s *Session) write() error {
+	byts, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error encoding session marker: %w", err)
+	}
+	path := markerPath(s.Dir)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Error writing session marker: %w", err)
+	}
+	if err := os.WriteFile(path, append(byts, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing session marker: %w", err)
+	}
+	return nil
+}
+
+// Read returns the session recorded in dir's marker. The error wraps
+// fs.ErrNotExist if dir isn't marked.
+func Read(dir string) (*Session, error) {
+	byts, err := os.ReadFile(markerPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err := json.Unmarshal(byts, s); err != nil {
+		return nil, fmt.Errorf("Error parsing session marker in %s: %w", dir, err)
+	}
+	s.Dir = dir
+	return s, nil
+}
+
+// Running reports whether the session's got-reload process is still running.
+// A session on another host (sharing the directory over the network, say)
+// is assumed to be.
+func (s *Session) Running() bool {
+	if host, _ := os.Hostname(); host != s.Host {
+		return true
+	}
+	return processExists(s.PID)
+}
+
+// Age returns how long ago the session started.
+func (s *Session) Age() time.Duration {
+	return time.Since(s.Created)
+}
+
+// Remove removes the session's directory, after checking that it's still
+// marked, and not by a running session other than ours.
+func (s *Session) Remove() error {
+	current, err := Read(s.Dir)
+	if err != nil {
+		return fmt.Errorf("Not removing %s: %w", s.Dir, err)
+	}
+	if current.Running() && current.PID != os.Getpid() {
+		return fmt.Errorf("Not removing %s: it's in use by got-reload (pid %d)", s.Dir, current.PID)
+	}
+	return os.RemoveAll(s.Dir)
+}
+
+// List returns the sessions in the temporary directories got-reload created,
+// and in dirs, oldest first. Unmarked directories are skipped.
+func List(dirs ...string) ([]*Session, error) {
+	temps, err := filepath.Glob(filepath.Join(os.TempDir(), TempPattern))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var sessions []*Session
+	for _, dir := range append(temps, dirs...) {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		s, err := Read(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
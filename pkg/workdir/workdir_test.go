@@ -0,0 +1,67 @@
+package workdir_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/got-reload/got-reload/pkg/workdir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepare(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "work")
+	s, err := workdir.Prepare(dir, "/src/module")
+	require.NoError(t, err, "preparing a new directory")
+	assert.False(t, s.Temp)
+	assert.Equal(t, os.Getpid(), s.PID)
+	assert.True(t, s.Running())
+	leftover := filepath.Join(dir, "p", "leftover.go")
+	require.NoError(t, os.MkdirAll(filepath.Dir(leftover), 0755))
+	require.NoError(t, os.WriteFile(leftover, nil, 0644))
+
+	// Our own session's directory can be reused, and is cleared.
+	_, err = workdir.Prepare(dir, "/src/module")
+	require.NoError(t, err, "reusing a directory")
+	assert.NoFileExists(t, leftover)
+	read, err := workdir.Read(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "/src/module", read.Module)
+
+	// Unmarked directories are left alone.
+	other := t.TempDir()
+	precious := filepath.Join(other, "precious")
+	require.NoError(t, os.WriteFile(precious, nil, 0644))
+	_, err = workdir.Prepare(other, "/src/module")
+	assert.Error(t, err, "preparing an unmarked directory")
+	assert.FileExists(t, precious)
+
+	sessions, err := workdir.List(dir, other)
+	require.NoError(t, err)
+	var dirs []string
+	for _, s := range sessions {
+		dirs = append(dirs, s.Dir)
+	}
+	assert.Contains(t, dirs, dir)
+	assert.NotContains(t, dirs, other)
+
+	require.NoError(t, read.Remove())
+	assert.NoDirExists(t, dir)
+}
+
+func TestRunning(t *testing.T) {
+	host, err := os.Hostname()
+	require.NoError(t, err)
+
+	// A process that has exited.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	require.NoError(t, cmd.Run())
+	s := &workdir.Session{PID: cmd.Process.Pid, Host: host}
+	assert.False(t, s.Running())
+
+	// Sessions on other hosts are assumed to be running.
+	s.Host = host + ".elsewhere"
+	assert.True(t, s.Running())
+}